@@ -0,0 +1,27 @@
+package container
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Pool shares ring storage between pooled rings, in one size class
+// per power of two. The zero value is ready to use.
+type Pool[T comparable] struct {
+	classes [bits.UintSize]sync.Pool
+}
+
+// Get returns storage of length size, which must be a power of two
+func (p *Pool[T]) Get(size uint) *[]T {
+	if s, ok := p.classes[bits.TrailingZeros(size)].Get().(*[]T); ok {
+		return s
+	}
+
+	s := make([]T, size)
+	return &s
+}
+
+// Put returns storage from Get to its size class
+func (p *Pool[T]) Put(s *[]T) {
+	p.classes[bits.TrailingZeros(uint(len(*s)))].Put(s)
+}
@@ -8,6 +8,7 @@ import (
 var (
 	ErrRingFull  = errors.New("ring full")
 	ErrRingEmpty = errors.New("ring empty")
+	ErrRingSize  = errors.New("ring size must be a power of two")
 )
 
 type Ring[T comparable] struct {
@@ -15,10 +16,20 @@ type Ring[T comparable] struct {
 	size         uint
 	imask, lmask uint
 	start, end   uint
+
+	// pool, if set, lends buf only while the ring is non-empty
+	pool *Pool[T]
+	held *[]T
+}
+
+// ValidSize reports whether size is a usable ring capacity:
+// NewRing falls back to 0x1000 for any other size
+func ValidSize(size uint) bool {
+	return size != 0 && size&(size-1) == 0
 }
 
 func NewRing[T comparable](size uint) (r *Ring[T]) {
-	if size&(size-1) != 0 || size == 0 {
+	if !ValidSize(size) {
 		size = 0x1000
 	}
 
@@ -32,6 +43,47 @@ func NewRing[T comparable](size uint) (r *Ring[T]) {
 	return
 }
 
+// NewPooledRing returns a ring which takes its storage from pool
+// when written to, and returns it once emptied, so an idle ring
+// holds no memory
+func NewPooledRing[T comparable](size uint, pool *Pool[T]) (r *Ring[T]) {
+	if !ValidSize(size) {
+		size = 0x1000
+	}
+
+	r = &Ring[T]{
+		size:  size,
+		imask: size - 1,
+		lmask: 2*size - 1,
+		pool:  pool,
+	}
+
+	return
+}
+
+// Allocated reports whether the ring currently holds storage
+func (r *Ring[T]) Allocated() bool {
+	return r.buf != nil
+}
+
+func (r *Ring[T]) alloc() {
+	if r.buf == nil {
+		r.held = r.pool.Get(r.size)
+		r.buf = *r.held
+	}
+}
+
+// release returns a pooled ring's storage once it is empty
+func (r *Ring[T]) release() {
+	if r.pool == nil || r.buf == nil || !r.Empty() {
+		return
+	}
+
+	r.pool.Put(r.held)
+	r.buf, r.held = nil, nil
+	r.start, r.end = 0, 0
+}
+
 func (r *Ring[T]) Empty() bool {
 	return r.start == r.end
 }
@@ -53,6 +105,7 @@ func (r *Ring[T]) Push(val T) bool {
 		return false
 	}
 
+	r.alloc()
 	r.buf[r.end&r.imask] = val
 	r.end = (r.end + 1) & r.lmask
 
@@ -66,12 +119,60 @@ func (r *Ring[T]) Pop(val *T) bool {
 
 	*val = r.buf[r.start&r.imask]
 	r.start = (r.start + 1) & r.lmask
+	r.release()
 
 	return true
 }
 
 func (r *Ring[T]) Clear() {
 	r.start, r.end = 0, 0
+	r.release()
+}
+
+// Resize reallocates the ring with the given capacity, preserving
+// its contents. It fails if size is invalid or too small to hold
+// the elements currently in the ring.
+func (r *Ring[T]) Resize(size uint) error {
+	if !ValidSize(size) {
+		return ErrRingSize
+	}
+
+	n := r.Size()
+	if n > size {
+		return ErrRingFull
+	}
+
+	if r.buf == nil {
+		r.size = size
+		r.imask, r.lmask = size-1, 2*size-1
+		return nil
+	}
+
+	var (
+		buf  []T
+		held *[]T
+	)
+
+	if r.pool != nil {
+		held = r.pool.Get(size)
+		buf = *held
+	} else {
+		buf = make([]T, size)
+	}
+
+	for i := range n {
+		buf[i] = r.buf[(r.start+i)&r.imask]
+	}
+
+	if r.pool != nil {
+		r.pool.Put(r.held)
+	}
+
+	r.buf, r.held, r.size = buf, held, size
+	r.imask, r.lmask = size-1, 2*size-1
+	r.start, r.end = 0, n
+
+	return nil
 }
 
 // WriteFunc partially exposes the underlying memory to a callback
@@ -84,12 +185,16 @@ func (r *Ring[T]) WriteFunc(
 	w func([]T, any) (int, error),
 	arg any,
 ) (n int, err error) {
+	r.alloc()
+
 	from, to, wrap := r.end&r.imask, r.start&r.imask, false
 	if to <= from {
 		to = r.size
 		wrap = true
 	}
 
+	defer r.release()
+
 	n, err = w(r.buf[from:to], arg)
 	r.end = (r.end + uint(n)) & r.lmask
 	if err == nil || !wrap {
@@ -147,31 +252,83 @@ func (r *Ring[T]) WriteTo(w io.Writer) (n int64, err error) {
 	m, err = w.Write(br.buf[from:to])
 	r.start = (r.start + uint(m)) & r.lmask
 	if err != nil || !wrap {
-		return
+		r.release()
+		return int64(m), err
 	}
 
 	hold, to := m, r.end&r.imask
 	m, err = w.Write(br.buf[:to])
 	r.start = (r.start + uint(m)) & r.lmask
+	r.release()
 
 	return int64(m + hold), err
 }
 
+// ReadFunc exposes the unread elements to a callback in contiguous
+// slices, consuming as many as it reports: when the unread elements
+// wrap around the underlying slice bounds and the callback consumes
+// all of the first slice, it will be applied twice.
+func (r *Ring[T]) ReadFunc(rf func([]T, any) int, arg any) (n int) {
+	if r.Empty() {
+		return
+	}
+
+	defer r.release()
+
+	from, to, wrap := r.start&r.imask, r.end&r.imask, false
+	if to <= from {
+		to = r.size
+		wrap = true
+	}
+
+	n = rf(r.buf[from:to], arg)
+	r.start = (r.start + uint(n)) & r.lmask
+	if !wrap || n < int(to-from) || r.Empty() {
+		return
+	}
+
+	hold := n
+	n = rf(r.buf[:r.end&r.imask], arg)
+	r.start = (r.start + uint(n)) & r.lmask
+
+	return n + hold
+}
+
+// Peek copies unread elements into p without consuming them,
+// returning the number copied
+func (r *Ring[T]) Peek(p []T) (n int) {
+	for ; n < len(p) && uint(n) < r.Size(); n++ {
+		p[n] = r.buf[(r.start+uint(n))&r.imask]
+	}
+	return
+}
+
 func (r *Ring[T]) Read(p []byte) (n int, err error) {
 	if r.Empty() {
 		err = io.EOF
 		return
 	}
 
+	defer r.release()
+
 	br := any(r).(*Ring[byte])
 
-	for ; n < len(p); n++ {
-		if !br.Pop(&p[n]) {
-			return
-		}
+	from, to, wrap := r.start&r.imask, r.end&r.imask, false
+	if to <= from {
+		to = r.size
+		wrap = true
 	}
 
-	return
+	n = copy(p, br.buf[from:to])
+	r.start = (r.start + uint(n)) & r.lmask
+	if !wrap || n < int(to-from) || r.Empty() {
+		return
+	}
+
+	m := copy(p[n:], br.buf[:r.end&r.imask])
+	r.start = (r.start + uint(m)) & r.lmask
+
+	return n + m, nil
 }
 
 func (r *Ring[T]) ReadFrom(src io.Reader) (n int64, err error) {
@@ -180,6 +337,9 @@ func (r *Ring[T]) ReadFrom(src io.Reader) (n int64, err error) {
 		return
 	}
 
+	r.alloc()
+	defer r.release()
+
 	br := any(r).(*Ring[byte])
 
 	from, to, wrap := r.end&r.imask, r.start&r.imask, false
@@ -191,8 +351,8 @@ func (r *Ring[T]) ReadFrom(src io.Reader) (n int64, err error) {
 	var m int
 	m, err = src.Read(br.buf[from:to])
 	r.end = (r.end + uint(m)) & r.lmask
-	if err != nil || !wrap {
-		return
+	if err != nil || !wrap || m < int(to-from) || r.Full() {
+		return int64(m), err
 	}
 
 	hold, to := m, r.start&r.imask
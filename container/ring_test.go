@@ -356,6 +356,30 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	r, b := container.NewRing[byte](0x8), byte(0)
+
+	// unread bytes wrap around the end of the ring
+	for range 6 {
+		r.Push(0)
+		r.Pop(&b)
+	}
+	r.Write([]byte("12345"))
+
+	p := make([]byte, 4)
+	if n := r.Peek(p); n != 4 || string(p) != "1234" {
+		t.Errorf("exp 1234, got %q\n", p[:n])
+	}
+
+	p = make([]byte, 8)
+	if n := r.Peek(p); n != 5 || string(p[:n]) != "12345" {
+		t.Errorf("exp 12345, got %q\n", p[:n])
+	}
+	if r.Size() != 5 {
+		t.Errorf("exp nothing consumed, got size %d\n", r.Size())
+	}
+}
+
 type hideWriteTo struct {
 	io.Reader
 }
@@ -477,3 +501,120 @@ func TestIndexOf(t *testing.T) {
 		})
 	}
 }
+
+type onceReader struct {
+	data  []byte
+	calls int
+}
+
+func (r *onceReader) Read(p []byte) (int, error) {
+	r.calls++
+	return copy(p, r.data), nil
+}
+
+func TestReadFromPartial(t *testing.T) {
+	r, b := container.NewRing[byte](0x10), byte(0)
+
+	for range 4 {
+		r.Push(0)
+		r.Pop(&b)
+	}
+
+	src := &onceReader{data: []byte("1234")}
+
+	if n, err := r.ReadFrom(src); n != 4 || err != nil {
+		t.Errorf("exp (4, nil), got (%d, %v)\n", n, err)
+		return
+	}
+	if src.calls != 1 {
+		t.Errorf("exp 1 read after a short read, got %d\n", src.calls)
+	}
+}
+
+func TestResize(t *testing.T) {
+	r, b := container.NewRing[byte](0x8), byte(0)
+
+	for range 6 {
+		r.Push(0)
+		r.Pop(&b)
+	}
+
+	r.Write([]byte("12345"))
+
+	if err := r.Resize(0x3); err != container.ErrRingSize {
+		t.Errorf("exp %v, got %v\n", container.ErrRingSize, err)
+	}
+	if err := r.Resize(0x4); err != container.ErrRingFull {
+		t.Errorf("exp %v, got %v\n", container.ErrRingFull, err)
+	}
+
+	if err := r.Resize(0x10); err != nil {
+		t.Errorf("exp nil, got %v\n", err)
+		return
+	}
+
+	r.Write([]byte("6789abcdefg"))
+
+	if !r.Full() || r.Cap() != 0x10 {
+		t.Errorf("exp full at 0x10, got (%t, %d)\n", r.Full(), r.Cap())
+	}
+
+	data := make([]byte, 0x10)
+	r.Read(data)
+
+	if exp := "123456789abcdefg"; string(data) != exp {
+		t.Errorf("exp %s, got %s\n", exp, data)
+		return
+	}
+
+	r.Write([]byte("12"))
+
+	if err := r.Resize(0x2); err != nil || !r.Full() {
+		t.Errorf("exp full, got (%t, %v)\n", r.Full(), err)
+	}
+}
+
+func TestPooledRing(t *testing.T) {
+	pool := new(container.Pool[byte])
+	r := container.NewPooledRing(0x8, pool)
+
+	if r.Allocated() {
+		t.Errorf("exp a new pooled ring to hold no storage\n")
+	}
+
+	r.Write([]byte("1234"))
+	if !r.Allocated() || r.Size() != 4 {
+		t.Errorf("exp storage holding 4 bytes, got (%t, %d)\n", r.Allocated(), r.Size())
+	}
+
+	data := make([]byte, 2)
+	r.Read(data)
+	if !r.Allocated() {
+		t.Errorf("exp storage held until the ring empties\n")
+	}
+
+	r.Read(data)
+	if r.Allocated() {
+		t.Errorf("exp storage released once the ring empties\n")
+	}
+
+	if err := r.Resize(0x10); err != nil || r.Allocated() || r.Cap() != 0x10 {
+		t.Errorf("exp empty ring resized without storage, got (%t, %v)\n", r.Allocated(), err)
+	}
+
+	r.ReadFrom(strings.NewReader("abc"))
+	if err := r.Resize(0x4); err != nil || r.Cap() != 0x4 {
+		t.Errorf("exp resize to 0x4, got %v\n", err)
+	}
+
+	data = make([]byte, 3)
+	r.Read(data)
+	if string(data) != "abc" || r.Allocated() {
+		t.Errorf("exp abc and no storage, got (%s, %t)\n", data, r.Allocated())
+	}
+
+	s := pool.Get(0x4)
+	if len(*s) != 0x4 {
+		t.Errorf("exp storage of length 0x4, got %d\n", len(*s))
+	}
+}
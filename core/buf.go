@@ -18,17 +18,37 @@ type Buf interface {
 type RingBuf struct {
 	*container.Ring[byte]
 	r io.Reader
+
+	// wake receives the first read into an unallocated pooled ring,
+	// so that waiting for data does not hold pooled storage
+	wake [0x10]byte
 }
 
 func NewRingBuf(size uint, r io.Reader) *RingBuf {
 	return &RingBuf{
-		container.NewRing[byte](size),
-		r,
+		Ring: container.NewRing[byte](size),
+		r:    r,
+	}
+}
+
+// NewPooledRingBuf returns a RingBuf whose storage is borrowed from
+// pool only while it holds unread bytes
+func NewPooledRingBuf(size uint, r io.Reader, pool *container.Pool[byte]) *RingBuf {
+	return &RingBuf{
+		Ring: container.NewPooledRing(size, pool),
+		r:    r,
 	}
 }
 
 func (r *RingBuf) Fill() (err error) {
-	_, err = io.Copy(r, r.r)
+	if !r.Allocated() {
+		var n int
+		n, err = r.r.Read(r.wake[:])
+		r.Write(r.wake[:n])
+		return
+	}
+
+	_, err = r.ReadFrom(r.r)
 	return
 }
 
@@ -5,7 +5,7 @@ import (
 )
 
 type Server interface {
-	Run(context.Context)
+	Run(context.Context) error
 	Accept() (Conn, error)
 	Close(Conn) error
 }
@@ -2,6 +2,8 @@ package http1
 
 import (
 	"iter"
+	"net/textproto"
+	"strconv"
 	"strings"
 
 	"github.com/willmroliver/wsgo/core"
@@ -19,6 +21,8 @@ type Message struct {
 	StatusCode, StatusText string
 	Headers                map[string]string
 	HeaderParsed           bool
+
+	values map[string][]string
 }
 
 func NewMessage() *Message {
@@ -27,27 +31,32 @@ func NewMessage() *Message {
 
 func (m *Message) Decode(c core.Conn) error {
 	m.Headers = make(map[string]string)
+	m.values = make(map[string][]string)
 	m.HeaderParsed = false
 
-	i := -1
+	// bytes read ahead of the header, e.g. with a PROXY header,
+	// may already hold all of it
+	i := c.Buf().IndexOf([]byte(DelimHTTP))
 
 	for i == -1 {
 		if c.Buf().Full() {
 			return core.ErrBadHeader
 		}
 
-		c.Buf().Fill()
+		err := c.Buf().Fill()
 
-		i = c.Buf().IndexOf([]byte(DelimHTTP))
+		if i = c.Buf().IndexOf([]byte(DelimHTTP)); i == -1 && err != nil {
+			return err
+		}
 	}
 
-	bytes := make([]byte, i)
+	bytes := make([]byte, i+len(DelimHTTP))
 	_, err := c.Buf().Read(bytes)
 	if err != nil {
 		return err
 	}
 
-	it := strings.SplitSeq(string(bytes), CRLF)
+	it := strings.SplitSeq(string(bytes[:i]), CRLF)
 	next, _ := iter.Pull(it)
 	line, ok := next()
 
@@ -81,13 +90,68 @@ func (m *Message) Decode(c core.Conn) error {
 			return core.ErrBadHeader
 		}
 
-		m.Headers[line[:i]] = line[i+2:]
+		k, v := line[:i], strings.TrimSpace(line[i+1:])
+		m.Headers[k] = v
+
+		key := textproto.CanonicalMIMEHeaderKey(k)
+		m.values[key] = append(m.values[key], v)
 	}
 
 	m.HeaderParsed = true
 	return nil
 }
 
+// DecodeBody reads a Content-Length delimited body following a
+// decoded header, reading at most limit bytes
+func (m *Message) DecodeBody(c core.Conn, limit int) (body []byte, err error) {
+	n, _ := strconv.Atoi(m.Get("Content-Length"))
+	if n <= 0 {
+		return
+	}
+
+	body = make([]byte, min(n, limit))
+	buf, read := c.Buf(), 0
+
+	for read < len(body) {
+		if buf.Available() == 0 {
+			if err = buf.Fill(); err != nil && buf.Available() == 0 {
+				return body[:read], err
+			}
+		}
+
+		var k int
+		if k, err = buf.Read(body[read:]); err != nil {
+			return body[:read], err
+		}
+
+		read += k
+	}
+
+	return
+}
+
+// Get returns the first value of the named header, matching
+// the name case-insensitively
+func (m *Message) Get(key string) string {
+	if v := m.Values(key); len(v) > 0 {
+		return v[0]
+	}
+
+	for k, v := range m.Headers {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// Values returns every decoded value of the named header, for
+// headers such as Set-Cookie which may repeat
+func (m *Message) Values(key string) []string {
+	return m.values[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
 func (m *Message) Encode(c core.Conn) (err error) {
 	var b strings.Builder
 
@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+var ErrAccessDenied = errors.New("connection refused by access list")
+
+// AccessList filters connections by the peer's IP address. An
+// address in Deny is refused; otherwise it is accepted if Allow is
+// empty or contains it. Peers without an IP address, such as over
+// unix sockets, are refused only by a non-empty Allow.
+//
+// Set replaces the lists at any time, for connections accepted
+// afterwards, and is safe for concurrent use. A nil *AccessList
+// accepts everything.
+type AccessList struct {
+	rules atomic.Pointer[accessRules]
+}
+
+type accessRules struct {
+	allow, deny []netip.Prefix
+}
+
+func NewAccessList(allow, deny []netip.Prefix) *AccessList {
+	l := new(AccessList)
+	l.Set(allow, deny)
+	return l
+}
+
+func (l *AccessList) Set(allow, deny []netip.Prefix) {
+	l.rules.Store(&accessRules{
+		allow: masked(allow),
+		deny:  masked(deny),
+	})
+}
+
+func masked(ps []netip.Prefix) []netip.Prefix {
+	out := make([]netip.Prefix, len(ps))
+	for i, p := range ps {
+		out[i] = p.Masked()
+	}
+	return out
+}
+
+// Allows reports whether a peer at ip is accepted
+func (l *AccessList) Allows(ip netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	r := l.rules.Load()
+	if r == nil {
+		return true
+	}
+
+	if !ip.IsValid() {
+		return len(r.allow) == 0
+	}
+
+	ip = ip.Unmap()
+
+	for _, p := range r.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(r.allow) == 0 {
+		return true
+	}
+
+	for _, p := range r.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *AccessList) allowsAddr(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	ip, _ := addrIP(addr)
+	return l.Allows(ip)
+}
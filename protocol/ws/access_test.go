@@ -0,0 +1,84 @@
+package ws_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func prefixes(ss ...string) (ps []netip.Prefix) {
+	for _, s := range ss {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return
+}
+
+func TestAccessList(t *testing.T) {
+	l := ws.NewAccessList(
+		prefixes("10.0.0.0/8", "192.168.0.0/16", "fd00::/8"),
+		prefixes("10.6.6.0/24"),
+	)
+
+	tests := []struct {
+		ip  string
+		exp bool
+	}{
+		{"10.1.2.3", true},
+		{"10.6.6.6", false},
+		{"::ffff:192.168.1.1", true},
+		{"fd12::1", true},
+		{"203.0.113.1", false},
+		{"2001:db8::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := l.Allows(netip.MustParseAddr(tt.ip)); got != tt.exp {
+			t.Errorf("%s: exp %v, got %v\n", tt.ip, tt.exp, got)
+		}
+	}
+
+	if l.Allows(netip.Addr{}) {
+		t.Errorf("exp peer without an IP refused by allow list\n")
+	}
+
+	l.Set(nil, prefixes("203.0.113.0/24"))
+
+	if !l.Allows(netip.MustParseAddr("198.51.100.1")) ||
+		l.Allows(netip.MustParseAddr("203.0.113.1")) {
+		t.Errorf("exp deny list alone to refuse only its ranges\n")
+	}
+
+	var none *ws.AccessList
+	if !none.Allows(netip.MustParseAddr("203.0.113.1")) {
+		t.Errorf("exp nil access list to allow everything\n")
+	}
+}
+
+func TestAccessReload(t *testing.T) {
+	access := ws.NewAccessList(prefixes("10.0.0.0/8"), nil)
+
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Conf.Access = access
+	})
+
+	if c, err := ws.Dial(url, ws.ClientConfig{}); err == nil {
+		c.Close()
+		t.Fatalf("exp loopback refused by allow list\n")
+	}
+
+	access.Set(prefixes("10.0.0.0/8", "127.0.0.0/8"), nil)
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatalf("exp loopback allowed after reload, got %v\n", err)
+	}
+	c.Close()
+
+	access.Set(nil, prefixes("127.0.0.1/32"))
+
+	if c, err := ws.Dial(url, ws.ClientConfig{}); err == nil {
+		c.Close()
+		t.Fatalf("exp loopback refused by deny list\n")
+	}
+}
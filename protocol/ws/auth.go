@@ -0,0 +1,264 @@
+package ws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoToken       = errors.New("no token in handshake")
+	ErrBadToken      = errors.New("invalid token")
+	ErrTokenExpired  = errors.New("token expired or not yet valid")
+	ErrTokenNoExpiry = errors.New("token has no expiry")
+	ErrTokenAudience = errors.New("token audience mismatch")
+)
+
+// Claims are the decoded JSON claims of a verified token. Numeric
+// values, such as exp, are float64.
+type Claims map[string]any
+
+// TokenAuth requires a signed token in each opening handshake: an
+// HS256 JWT, or a ticket of the form claims "." signature, where
+// claims is base64url-encoded JSON and signature its base64url
+// HMAC-SHA256 (both unpadded).
+//
+// The token is taken from the first found of the Query parameter,
+// Header (with any "Bearer " prefix removed), Cookie, and the
+// Sec-WebSocket-Protocol entry beginning with Protocol, for each
+// which is named: Query defaults to "token" if none are. A token
+// from Sec-WebSocket-Protocol is echoed back as the subprotocol, as
+// browsers require.
+//
+// Tokens are verified with the key named by their "kid", from the
+// JWT header or ticket claims, or else the key for "". SetKeys
+// rotates keys at any time: keep the old key ID until its tokens
+// expire. exp and nbf are checked allowing Leeway for clock skew,
+// and Audience, if set, must appear in aud. Tokens without exp are
+// refused unless AllowNoExpiry is set. Clock, if set, replaces the
+// system clock.
+type TokenAuth struct {
+	Query    string
+	Header   string
+	Cookie   string
+	Protocol string
+	Audience string
+	Leeway   time.Duration
+	Clock    Clock
+
+	AllowNoExpiry bool
+
+	keys atomic.Pointer[map[string][]byte]
+}
+
+func NewTokenAuth(keys map[string][]byte) *TokenAuth {
+	a := new(TokenAuth)
+	a.SetKeys(keys)
+	return a
+}
+
+func (a *TokenAuth) SetKeys(keys map[string][]byte) {
+	a.keys.Store(&keys)
+}
+
+// authenticate verifies the token in a request for target, returning
+// its claims and the subprotocol which carried it, if any
+func (a *TokenAuth) authenticate(
+	target string,
+	header func(string) string,
+) (claims Claims, protocol string, err error) {
+	token, protocol := a.token(target, header)
+	if token == "" {
+		err = ErrNoToken
+		return
+	}
+
+	claims, err = a.Verify(token)
+	return
+}
+
+// token finds the token in a request
+func (a *TokenAuth) token(target string, header func(string) string) (token, protocol string) {
+	query := a.Query
+	if query == "" && a.Header == "" && a.Cookie == "" && a.Protocol == "" {
+		query = "token"
+	}
+
+	if query != "" {
+		if _, q, ok := strings.Cut(target, "?"); ok {
+			if v, err := url.ParseQuery(q); err == nil && v.Get(query) != "" {
+				return v.Get(query), ""
+			}
+		}
+	}
+
+	if a.Header != "" {
+		v := header(a.Header)
+		if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+			v = v[7:]
+		}
+		if v = strings.TrimSpace(v); v != "" {
+			return v, ""
+		}
+	}
+
+	if a.Cookie != "" {
+		if cookies, err := http.ParseCookie(header("Cookie")); err == nil {
+			for _, c := range cookies {
+				if c.Name == a.Cookie && c.Value != "" {
+					return c.Value, ""
+				}
+			}
+		}
+	}
+
+	if a.Protocol != "" {
+		for p := range strings.SplitSeq(header("Sec-WebSocket-Protocol"), ",") {
+			p = strings.TrimSpace(p)
+			if t, ok := strings.CutPrefix(p, a.Protocol); ok && t != "" {
+				return t, p
+			}
+		}
+	}
+
+	return
+}
+
+// Verify checks the signature and validity of token, returning its
+// claims
+func (a *TokenAuth) Verify(token string) (claims Claims, err error) {
+	parts := strings.Split(token, ".")
+
+	var kid, signed string
+	var sig []byte
+
+	switch len(parts) {
+	case 3:
+		var hdr struct {
+			Alg string `json:"alg"`
+			Kid string `json:"kid"`
+		}
+
+		// only HS256 is accepted, whatever the token claims
+		if err = decodeSegment(parts[0], &hdr); err != nil || hdr.Alg != "HS256" {
+			return nil, ErrBadToken
+		}
+		if err = decodeSegment(parts[1], &claims); err != nil {
+			return nil, ErrBadToken
+		}
+
+		kid, signed = hdr.Kid, parts[0]+"."+parts[1]
+	case 2:
+		if err = decodeSegment(parts[0], &claims); err != nil {
+			return nil, ErrBadToken
+		}
+
+		kid, _ = claims["kid"].(string)
+		signed = parts[0]
+	default:
+		return nil, ErrBadToken
+	}
+
+	if sig, err = base64.RawURLEncoding.DecodeString(parts[len(parts)-1]); err != nil {
+		return nil, ErrBadToken
+	}
+
+	var key []byte
+	if keys := a.keys.Load(); keys != nil {
+		key = (*keys)[kid]
+	}
+	if key == nil {
+		return nil, ErrBadToken
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrBadToken
+	}
+
+	if err = a.check(claims); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func decodeSegment(s string, v any) error {
+	p, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
+
+// check validates the registered claims exp, nbf and aud
+func (a *TokenAuth) check(claims Claims) error {
+	clock := a.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	now := clock.Now()
+
+	if v, ok := claims["exp"]; ok {
+		exp, ok := v.(float64)
+		if !ok {
+			return ErrBadToken
+		}
+		if now.After(unixTime(exp).Add(a.Leeway)) {
+			return ErrTokenExpired
+		}
+	} else if !a.AllowNoExpiry {
+		return ErrTokenNoExpiry
+	}
+
+	if v, ok := claims["nbf"]; ok {
+		nbf, ok := v.(float64)
+		if !ok {
+			return ErrBadToken
+		}
+		if now.Add(a.Leeway).Before(unixTime(nbf)) {
+			return ErrTokenExpired
+		}
+	}
+
+	if a.Audience != "" && !hasAudience(claims["aud"], a.Audience) {
+		return ErrTokenAudience
+	}
+
+	return nil
+}
+
+func unixTime(secs float64) time.Time {
+	return time.Unix(0, int64(secs*float64(time.Second)))
+}
+
+// hasAudience reports whether aud, a string or array of strings,
+// contains want
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, v := range aud {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claims returns the claims of the token verified by the server's
+// TokenAuth during the handshake, if any
+func (c *Conn) Claims() Claims {
+	return c.claims
+}
@@ -0,0 +1,162 @@
+package ws_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+	"github.com/willmroliver/wsgo/test"
+)
+
+func segment(v any) string {
+	p, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(p)
+}
+
+func sign(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return s + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func jwt(key []byte, kid string, claims ws.Claims) string {
+	hdr := map[string]string{"alg": "HS256", "typ": "JWT"}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	return sign(key, segment(hdr)+"."+segment(claims))
+}
+
+func ticket(key []byte, claims ws.Claims) string {
+	return sign(key, segment(claims))
+}
+
+func TestTokenVerify(t *testing.T) {
+	clock := test.NewClock()
+	clock.Advance(1000 * time.Second)
+
+	k1, k2 := []byte("first secret"), []byte("second secret")
+
+	a := ws.NewTokenAuth(map[string][]byte{"k1": k1, "k2": k2, "": k1})
+	a.Audience = "chat"
+	a.Leeway = 5 * time.Second
+	a.Clock = clock
+
+	valid := ws.Claims{"sub": "ann", "aud": "chat", "exp": 1100, "nbf": 900}
+
+	none := sign(nil, segment(map[string]string{"alg": "none"})+"."+segment(valid))
+	forged := jwt(k2, "k1", valid)
+
+	tests := []struct {
+		name  string
+		token string
+		exp   error
+	}{
+		{"jwt", jwt(k1, "k1", valid), nil},
+		{"jwt rotated key", jwt(k2, "k2", valid), nil},
+		{"jwt default key", jwt(k1, "", valid), nil},
+		{"ticket", ticket(k2, ws.Claims{"kid": "k2", "aud": []string{"admin", "chat"}, "exp": 1100}), nil},
+		{"within leeway", jwt(k1, "k1", ws.Claims{"aud": "chat", "exp": 997}), nil},
+		{"expired", jwt(k1, "k1", ws.Claims{"aud": "chat", "exp": 990}), ws.ErrTokenExpired},
+		{"not yet valid", jwt(k1, "k1", ws.Claims{"aud": "chat", "exp": 1100, "nbf": 1010}), ws.ErrTokenExpired},
+		{"no expiry", jwt(k1, "k1", ws.Claims{"aud": "chat"}), ws.ErrTokenNoExpiry},
+		{"wrong audience", jwt(k1, "k1", ws.Claims{"aud": "admin", "exp": 1100}), ws.ErrTokenAudience},
+		{"no audience", jwt(k1, "k1", ws.Claims{"exp": 1100}), ws.ErrTokenAudience},
+		{"wrong key", forged, ws.ErrBadToken},
+		{"unknown kid", jwt(k1, "k3", valid), ws.ErrBadToken},
+		{"alg none", none, ws.ErrBadToken},
+		{"garbage", "not.a.token", ws.ErrBadToken},
+	}
+
+	for _, tt := range tests {
+		claims, err := a.Verify(tt.token)
+		if !errors.Is(err, tt.exp) {
+			t.Errorf("%s: exp %v, got %v\n", tt.name, tt.exp, err)
+		}
+		if err == nil && claims == nil {
+			t.Errorf("%s: exp claims\n", tt.name)
+		}
+	}
+
+	// unless expiry is optional
+	a.AllowNoExpiry = true
+	if _, err := a.Verify(jwt(k1, "k1", ws.Claims{"aud": "chat"})); err != nil {
+		t.Errorf("exp token without expiry allowed, got %v\n", err)
+	}
+
+	// retiring a key rejects its tokens
+	a.SetKeys(map[string][]byte{"k2": k2})
+	if _, err := a.Verify(jwt(k1, "k1", valid)); !errors.Is(err, ws.ErrBadToken) {
+		t.Errorf("exp retired key rejected, got %v\n", err)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	key := []byte("secret")
+
+	auth := ws.NewTokenAuth(map[string][]byte{"": key})
+	auth.Query = "token"
+	auth.Header = "Authorization"
+	auth.Cookie = "session"
+	auth.Protocol = "access_token."
+
+	// the path is matched apart from the query carrying a token
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Conf.Path = "/chat"
+		s.Conf.Auth = auth
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			sub, _ := c.Claims()["sub"].(string)
+			reply := ws.NewMessage(ws.OpcodeText).SetPayload([]byte(sub))
+			reply.FIN = true
+			reply.Encode(c)
+		})
+	})
+
+	url += "chat"
+
+	token := jwt(key, "", ws.Claims{"sub": "ann", "exp": time.Now().Add(time.Minute).Unix()})
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+	}{
+		{"query", "?token=" + token, nil},
+		{"header", "", map[string]string{"Authorization": "Bearer " + token}},
+		{"cookie", "", map[string]string{"Cookie": "theme=dark; session=" + token}},
+		{"protocol", "", map[string]string{"Sec-WebSocket-Protocol": "chat, access_token." + token}},
+	}
+
+	for _, tt := range tests {
+		c, err := ws.Dial(url+tt.path, ws.ClientConfig{Headers: tt.headers})
+		if err != nil {
+			t.Errorf("%s: %v\n", tt.name, err)
+			continue
+		}
+
+		m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("?"))
+		m.FIN = true
+		if err = m.Encode(c); err == nil {
+			err = m.Decode(c)
+		}
+		if err != nil || string(m.Payload) != "ann" {
+			t.Errorf("%s: exp claims attached, got %q (%v)\n", tt.name, m.Payload, err)
+		}
+
+		c.Close()
+	}
+
+	for _, path := range []string{"", "?token=" + ticket([]byte("wrong"), ws.Claims{})} {
+		_, err := ws.Dial(url+path, ws.ClientConfig{})
+
+		var herr *ws.HandshakeError
+		if !errors.As(err, &herr) || herr.StatusCode != "401" {
+			t.Errorf("exp 401 Unauthorized, got %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCertInterval is how often a CertReloader checks its files
+const DefaultCertInterval = 10 * time.Second
+
+// CertReloader provides a TLS certificate loaded from CertFile and
+// KeyFile, reloading it once Run sees either file change. Use it as
+// the tls.Config GetCertificate of a Server's TLS, so that new
+// handshakes receive the latest certificate while established
+// connections keep theirs.
+//
+// Files are checked every Interval (default DefaultCertInterval) by
+// modification time and size. A failed reload, such as while one of
+// the pair has yet to be replaced, keeps the previous certificate
+// and is logged to ErrorLog (or the standard logger if nil). It is
+// retried once either file changes again.
+type CertReloader struct {
+	CertFile, KeyFile string
+	Interval          time.Duration
+	ErrorLog          *log.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// stamp identifies the files loaded, and failed those which
+	// last failed to load, so that each version is tried once
+	mu     sync.Mutex
+	stamp  [2]fileStamp
+	failed [2]fileStamp
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// NewCertReloader loads the certificate in certFile and keyFile,
+// failing if it can't
+func NewCertReloader(certFile, keyFile string) (r *CertReloader, err error) {
+	r = &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload loads the certificate at once, replacing the current one
+// only if it succeeds
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reload()
+}
+
+func (r *CertReloader) reload() error {
+	stamp, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		r.failed = stamp
+		return err
+	}
+
+	r.cert.Store(&cert)
+	r.stamp = stamp
+	return nil
+}
+
+func (r *CertReloader) stat() (stamp [2]fileStamp, err error) {
+	for i, name := range []string{r.CertFile, r.KeyFile} {
+		var fi os.FileInfo
+		if fi, err = os.Stat(name); err != nil {
+			return
+		}
+		stamp[i] = fileStamp{fi.ModTime(), fi.Size()}
+	}
+	return
+}
+
+// GetCertificate returns the current certificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Run checks for changed files until ctx is done
+func (r *CertReloader) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultCertInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := r.check(); err != nil {
+			r.logf("ws: reloading certificate %s: %v", r.CertFile, err)
+		}
+	}
+}
+
+// check reloads the certificate if its files have changed since
+// they were last loaded or last failed to load
+func (r *CertReloader) check() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamp, err := r.stat()
+	if err != nil {
+		return err
+	}
+	if stamp == r.stamp || stamp == r.failed {
+		return nil
+	}
+
+	return r.reload()
+}
+
+func (r *CertReloader) logf(format string, args ...any) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,179 @@
+package ws_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// writeCert writes cert and its key as PEM files, moving their
+// modification times forward so that every write is seen
+func writeCert(t *testing.T, certFile, keyFile string, cert tls.Certificate, at time.Time) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		certFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		keyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+	}
+
+	for name, p := range files {
+		if err := os.WriteFile(name, p, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncBuffer collects log output written from another goroutine
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.b.Reset()
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// serverName dials url and returns the common name of the server's
+// certificate
+func serverName(url string, ca *testCA) (string, error) {
+	c, err := ws.Dial(url, ws.ClientConfig{TLS: clientTLS(ca)})
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	state := c.Conn.(*tls.Conn).ConnectionState()
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
+
+// waitServerName waits for dials to url to see the certificate
+// issued to exp
+func waitServerName(t *testing.T, url string, ca *testCA, exp string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := serverName(url, ca)
+		if err == nil && got == exp {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("exp certificate for %s, got %q (%v)\n", exp, got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	ca := newCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	now := time.Now()
+	writeCert(t, certFile, keyFile, ca.issue(t, "server-1"), now)
+
+	r, err := ws.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs syncBuffer
+	r.Interval = 5 * time.Millisecond
+	r.ErrorLog = log.New(&logs, "", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	_, url := runServer(t, func(s *ws.Server) {
+		s.TLS = &tls.Config{GetCertificate: r.GetCertificate}
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			m.Encode(c)
+		})
+	})
+	url = "wss" + strings.TrimPrefix(url, "ws")
+
+	waitServerName(t, url, ca, "server-1")
+
+	c, err := ws.Dial(url, ws.ClientConfig{TLS: clientTLS(ca)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writeCert(t, certFile, keyFile, ca.issue(t, "server-2"), now.Add(time.Second))
+	waitServerName(t, url, ca, "server-2")
+
+	// established connections are unaffected
+	if err := echo(c, []byte("still here")); err != nil {
+		t.Errorf("exp existing connection kept, got %v\n", err)
+	}
+
+	// a broken pair is logged, and the last good certificate kept.
+	// The rotation above may have logged a mismatched pair already,
+	// if a check fell between its writes.
+	logs.Reset()
+
+	broken := filepath.Join(dir, "broken.pem")
+	if err := os.WriteFile(broken, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(broken, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "reloading certificate") {
+		if time.Now().After(deadline) {
+			t.Fatalf("exp failed reload logged\n")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got, err := serverName(url, ca); err != nil || got != "server-2" {
+		t.Errorf("exp previous certificate kept, got %q (%v)\n", got, err)
+	}
+
+	if strings.Count(logs.String(), "\n") != 1 {
+		t.Errorf("exp failure logged once, got %q\n", logs.String())
+	}
+}
+
+func TestNewCertReloaderMissing(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ws.NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Errorf("exp error loading missing files\n")
+	}
+}
@@ -1,22 +1,207 @@
 package ws
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/willmroliver/wsgo/core"
 	"github.com/willmroliver/wsgo/protocol/http1"
 )
 
-var ErrHandshakeFailed = errors.New("server rejected handshake")
+const maxErrBodySize = 0x1000
+
+var (
+	ErrHandshakeFailed = errors.New("server rejected handshake")
+	ErrProxyFailed     = errors.New("proxy rejected CONNECT")
+	ErrBadScheme       = errors.New("unsupported URL scheme")
+)
+
+// HandshakeError reports the final non-101 response received
+// during a client handshake
+type HandshakeError struct {
+	StatusCode, StatusText string
+	Headers                map[string]string
+	Body                   []byte
+}
+
+func (e *HandshakeError) Error() string {
+	return ErrHandshakeFailed.Error() + ": " + e.StatusCode + " " + e.StatusText
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrHandshakeFailed
+}
+
+// ClientConfig configures the opening handshake sent by a ClientConn.
+//
+// Headers are sent in addition to (or in place of) the default
+// upgrade headers. A non-nil Jar supplies and stores cookies, and
+// up to MaxRedirects 3xx responses are followed by re-dialing.
+//
+// Proxy returns the http:// proxy to tunnel through with CONNECT, or
+// nil to connect directly. If unset, ProxyFromEnvironment is used.
+//
+// NetDial, if set, replaces net.Dial for the server or proxy, e.g.
+// to connect over a unix socket regardless of the URL's host.
+//
+// ConnBufSize and WriteBufSize size the read buffer and socket
+// send buffer as in ServerConfig.
+//
+// wss:// URLs are dialed over TLS configured by TLS, if set, whose
+// Certificates present a client certificate to servers requiring
+// one. ServerName defaults to the URL's host.
+type ClientConfig struct {
+	Headers      map[string]string
+	Jar          http.CookieJar
+	MaxRedirects int
+	Proxy        func(*url.URL) (*url.URL, error)
+	NetDial      func(network, address string) (net.Conn, error)
+	ConnBufSize  uint
+	WriteBufSize int
+	TLS          *tls.Config
+}
+
+// ProxyFromEnvironment selects a proxy for a URL from HTTPS_PROXY
+// (for wss://) or HTTP_PROXY (for ws://), or their lowercase forms.
+//
+// Hosts matching an entry in NO_PROXY, and loopback hosts, are
+// connected to directly. The environment is read on every call.
+func ProxyFromEnvironment(u *url.URL) (*url.URL, error) {
+	key := "HTTP_PROXY"
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		key = "HTTPS_PROXY"
+	}
+
+	proxy := getenv(key)
+	if proxy == "" || !useProxy(u, getenv("NO_PROXY")) {
+		return nil, nil
+	}
+
+	p, err := url.Parse(proxy)
+	if err != nil || p.Host == "" {
+		// allow the common "host:port" shorthand
+		if p, err = url.Parse("http://" + proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func getenv(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(key))
+}
+
+// useProxy reports whether u's host is excluded by noProxy, a
+// comma-separated list of hosts, domain suffixes, IPs and CIDRs
+func useProxy(u *url.URL, noProxy string) bool {
+	// an empty host, as in ":9001", dials the local system
+	host := u.Hostname()
+	if host == "" || host == "localhost" {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	for entry := range strings.SplitSeq(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return false
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+
+		if h, port, err := net.SplitHostPort(entry); err == nil {
+			if port != u.Port() {
+				continue
+			}
+			entry = h
+		}
+
+		entry = strings.TrimPrefix(entry, "*")
+		host := strings.ToLower(host)
+
+		if host == strings.TrimPrefix(entry, ".") ||
+			strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ProxyURL returns a Proxy func which always selects proxy
+func ProxyURL(proxy *url.URL) func(*url.URL) (*url.URL, error) {
+	return func(*url.URL) (*url.URL, error) {
+		return proxy, nil
+	}
+}
 
 type ClientConn struct {
-	*net.TCPConn
+	net.Conn
 	Host, Path string
+	Conf       ClientConfig
+
+	addr   string
+	secure bool
+	user   *url.Userinfo
+	buf    core.Buf
+	wl     writeLock
+	open   atomic.Bool
+}
 
-	buf  core.Buf
-	open bool
+// NetConn returns the underlying network connection
+func (c *ClientConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Write sends p as a single unit. It is safe for concurrent use,
+// but p must hold whole frames: prefer Message.Encode.
+func (c *ClientConn) Write(p []byte) (n int, err error) {
+	c.wl.msg.Lock()
+	defer c.wl.msg.Unlock()
+
+	c.wl.lock(false)
+	defer c.wl.unlock()
+
+	return c.Conn.Write(p)
+}
+
+func (c *ClientConn) writeLock() *writeLock {
+	return &c.wl
+}
+
+func (c *ClientConn) writeFrame(_ byte, p []byte) (err error) {
+	_, err = c.Conn.Write(p)
+	return
+}
+
+func (c *ClientConn) writeBuffers(_ byte, bufs net.Buffers) (err error) {
+	_, err = bufs.WriteTo(c.Conn)
+	return
 }
 
 func (c *ClientConn) Buf() core.Buf {
@@ -24,17 +209,23 @@ func (c *ClientConn) Buf() core.Buf {
 }
 
 func (c *ClientConn) Open() bool {
-	return c.open
+	return c.open.Load()
+}
+
+// SetBufSize resizes the read buffer, keeping any bytes
+// already buffered
+func (c *ClientConn) SetBufSize(size uint) error {
+	return resizeBuf(c.buf, size)
 }
 
 func (c *ClientConn) Close() (err error) {
-	if err = CloseFrame.Encode(c); err != nil {
-		return err
+	if c.open.CompareAndSwap(true, false) {
+		if err = CloseFrame.Encode(c); err != nil {
+			return err
+		}
 	}
 
-	err = c.TCPConn.Close()
-	c.open = err != nil
-	return
+	return c.Conn.Close()
 }
 
 // Handshake sends an HTTP/1.x request to the server to
@@ -42,11 +233,51 @@ func (c *ClientConn) Close() (err error) {
 //
 // On receiving a 101 switch response, server and client
 // can proceed to send messages across the open channel.
+// Redirects are followed up to Conf.MaxRedirects times; any
+// other response is returned as a *HandshakeError.
 func (c *ClientConn) Handshake() (err error) {
-	if c.open {
+	if c.open.Load() {
 		return
 	}
 
+	for redirects := 0; ; redirects++ {
+		h := c.request()
+
+		if err = h.Encode(c); err != nil {
+			return
+		}
+		if err = h.Decode(c); err != nil {
+			return
+		}
+
+		c.storeCookies(h)
+
+		if h.StatusCode == "101" {
+			break
+		}
+
+		loc := h.Get("Location")
+		if isRedirect(h.StatusCode) && loc != "" && redirects < c.Conf.MaxRedirects {
+			if err = c.redirect(loc); err != nil {
+				return
+			}
+			continue
+		}
+
+		body, _ := h.DecodeBody(c, maxErrBodySize)
+		return &HandshakeError{
+			StatusCode: h.StatusCode,
+			StatusText: h.StatusText,
+			Headers:    h.Headers,
+			Body:       body,
+		}
+	}
+
+	c.open.Store(true)
+	return
+}
+
+func (c *ClientConn) request() *http1.Message {
 	h := http1.NewMessage()
 	h.ParseRequestLine("GET " + c.Path + " HTTP/1.1")
 	h.Headers = map[string]string{
@@ -58,42 +289,319 @@ func (c *ClientConn) Handshake() (err error) {
 		"Sec-WebSocket-Version":  "13",
 	}
 
-	if err = h.Encode(c); err != nil {
+	if c.user != nil {
+		pass, _ := c.user.Password()
+		auth := c.user.Username() + ":" + pass
+		h.Headers["Authorization"] = "Basic " +
+			base64.StdEncoding.EncodeToString([]byte(auth))
+	}
+
+	if c.Conf.Jar != nil {
+		var cookies []string
+		for _, ck := range c.Conf.Jar.Cookies(c.httpURL()) {
+			cookies = append(cookies, ck.Name+"="+ck.Value)
+		}
+		if len(cookies) > 0 {
+			h.Headers["Cookie"] = strings.Join(cookies, "; ")
+		}
+	}
+
+	for k, v := range c.Conf.Headers {
+		for d := range h.Headers {
+			if strings.EqualFold(k, d) {
+				delete(h.Headers, d)
+			}
+		}
+		h.Headers[k] = v
+	}
+
+	return h
+}
+
+func (c *ClientConn) storeCookies(h *http1.Message) {
+	if c.Conf.Jar == nil {
 		return
 	}
-	if err = h.Decode(c); err != nil {
+
+	res := http.Response{
+		Header: http.Header{"Set-Cookie": h.Values("Set-Cookie")},
+	}
+	if cookies := res.Cookies(); len(cookies) > 0 {
+		c.Conf.Jar.SetCookies(c.httpURL(), cookies)
+	}
+}
+
+// redirect closes the current connection and re-dials the
+// target of a Location header, resolved against the current URL
+func (c *ClientConn) redirect(loc string) (err error) {
+	base := &url.URL{Scheme: "ws", Host: c.addr}
+	if c.secure {
+		base.Scheme = "wss"
+	}
+	if base, err = base.Parse(c.Path); err != nil {
 		return
 	}
-	if h.StatusCode != "101" {
-		err = ErrHandshakeFailed
+
+	u, err := base.Parse(loc)
+	if err != nil {
 		return
 	}
 
-	c.open = true
+	// c keeps its previous conn, for the caller to close, unless
+	// the new one is established
+	prev, addr, secure := c.Conn, c.addr, c.secure
+	if err = c.connect(u); err != nil {
+		c.Conn, c.addr, c.secure = prev, addr, secure
+		c.buf.Reset(prev)
+		return
+	}
+
+	prev.Close()
+
+	// a relative Location resolves to c.addr, so the host changes
+	// only if u names neither that nor c.Host
+	moved := u.Host != base.Host && u.Host != c.Host
+	if moved || u.User != nil {
+		c.user = u.User
+	}
+
+	if moved {
+		c.Host = u.Host
+		c.Conf.Headers = withoutCredentials(c.Conf.Headers)
+	}
+
+	c.Path = u.RequestURI()
 	return
 }
 
-func NewClientConn(address, path string) (c *ClientConn, err error) {
-	addr, err := net.ResolveTCPAddr("tcp", address)
+// withoutCredentials returns a copy of headers without those which
+// must not follow a redirect to another host, as net/http does
+func withoutCredentials(headers map[string]string) map[string]string {
+	h := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if !strings.EqualFold(k, "Authorization") && !strings.EqualFold(k, "Cookie") {
+			h[k] = v
+		}
+	}
+	return h
+}
+
+// connect dials the server at u, tunnelling through a proxy
+// if one is configured, and resets c to read from the new conn
+func (c *ClientConn) connect(u *url.URL) (err error) {
+	addr, err := dialAddr(u)
+	if err != nil {
+		return
+	}
+
+	proxy := c.Conf.Proxy
+	if proxy == nil {
+		proxy = ProxyFromEnvironment
+	}
+
+	p, err := proxy(u)
 	if err != nil {
 		return
 	}
-	conn, err := net.DialTCP("tcp", nil, addr)
+
+	target := addr
+	if p != nil {
+		if p.Scheme != "http" {
+			return ErrBadScheme
+		}
+		if target, err = dialAddr(p); err != nil {
+			return
+		}
+	}
+
+	conn, err := c.dial(target)
+	if err != nil {
+		return
+	}
+
+	setWriteBuffer(conn, c.Conf.WriteBufSize)
+
+	c.Conn, c.addr = conn, addr
+	if c.buf == nil {
+		c.buf = core.NewRingBuf(bufSize(c.Conf.ConnBufSize), conn)
+	} else {
+		c.buf.Reset(conn)
+	}
+
+	if p != nil {
+		if err = c.tunnel(p); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	c.secure = isSecure(u)
+	if c.secure {
+		if err = c.handshakeTLS(u); err != nil {
+			conn.Close()
+		}
+	}
+
+	return
+}
+
+func isSecure(u *url.URL) bool {
+	return u.Scheme == "wss" || u.Scheme == "https"
+}
+
+// handshakeTLS secures the connection to u, after any tunnel
+func (c *ClientConn) handshakeTLS(u *url.URL) error {
+	conf := new(tls.Config)
+	if c.Conf.TLS != nil {
+		conf = c.Conf.TLS.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = u.Hostname()
+	}
+
+	tc := tls.Client(c.Conn, conf)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+
+	c.Conn = tc
+	c.buf.Reset(tc)
+	return nil
+}
+
+// tunnel asks the proxy at p to open a CONNECT tunnel to c.addr
+func (c *ClientConn) tunnel(p *url.URL) (err error) {
+	h := http1.NewMessage()
+	h.ParseRequestLine("CONNECT " + c.addr + " HTTP/1.1")
+	h.Headers["Host"] = c.addr
+
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		auth := p.User.Username() + ":" + pass
+		h.Headers["Proxy-Authorization"] = "Basic " +
+			base64.StdEncoding.EncodeToString([]byte(auth))
+	}
+
+	if err = h.Encode(c); err != nil {
+		return
+	}
+	if err = h.Decode(c); err != nil {
+		return
+	}
+	if len(h.StatusCode) != 3 || h.StatusCode[0] != '2' {
+		return fmt.Errorf("%w: %s %s", ErrProxyFailed, h.StatusCode, h.StatusText)
+	}
+
+	return
+}
+
+func (c *ClientConn) httpURL() *url.URL {
+	u := &url.URL{Scheme: "http", Host: c.addr}
+	if c.secure {
+		u.Scheme = "https"
+	}
+	if v, err := u.Parse(c.Path); err == nil {
+		u = v
+	}
+	return u
+}
+
+func isRedirect(status string) bool {
+	switch status {
+	case "301", "302", "303", "307", "308":
+		return true
+	}
+	return false
+}
+
+// dialAddr returns the host:port to dial for a ws:// or wss://
+// URL, also accepting http(s):// as given by redirect targets
+func dialAddr(u *url.URL) (string, error) {
+	port := "80"
+
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		port = "443"
+	default:
+		return "", ErrBadScheme
+	}
+
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func (c *ClientConn) dial(address string) (net.Conn, error) {
+	if c.Conf.NetDial != nil {
+		return c.Conf.NetDial("tcp", address)
+	}
+
+	return net.Dial("tcp", address)
+}
+
+// Dial connects to a ws:// or wss:// URL and performs the opening
+// handshake.
+//
+// User info in the URL is sent as HTTP basic auth.
+func Dial(rawURL string, conf ClientConfig) (c *ClientConn, err error) {
+	if err = checkBufSize(conf.ConnBufSize); err != nil {
+		return
+	}
+
+	u, err := url.Parse(rawURL)
 	if err != nil {
 		return
 	}
 
+	c = &ClientConn{
+		Host: u.Host,
+		Path: u.RequestURI(),
+		Conf: conf,
+
+		user: u.User,
+	}
+
+	if err = c.connect(u); err != nil {
+		return nil, err
+	}
+
+	if err = c.Handshake(); err != nil {
+		c.Conn.Close()
+		c = nil
+	}
+
+	return
+}
+
+// WrapClientConn returns a ClientConn over an established net.Conn,
+// which must then complete Handshake before exchanging frames
+func WrapClientConn(conn net.Conn, host, path string) *ClientConn {
+	return &ClientConn{
+		Conn: conn,
+		Host: host,
+		Path: path,
+
+		addr: host,
+		buf:  core.NewRingBuf(DefaultBufSize, conn),
+	}
+}
+
+func NewClientConn(address, path string) (c *ClientConn, err error) {
 	host := ""
 	if i := strings.IndexByte(address, ':'); i > 0 {
 		host = address[:i]
 	}
 
 	c = &ClientConn{
-		conn,
-		host,
-		path,
-		core.NewRingBuf(0x1000, conn),
-		false,
+		Host: host,
+		Path: path,
+	}
+
+	if err = c.connect(&url.URL{Scheme: "ws", Host: address}); err != nil {
+		return nil, err
 	}
 
 	return
@@ -1,8 +1,17 @@
 package ws_test
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -46,3 +55,383 @@ func TestHandshake(t *testing.T) {
 		return
 	}
 }
+
+// scriptedServer answers each accepted connection with the next
+// response in script, passing the parsed request to check
+func scriptedServer(
+	t *testing.T,
+	script []string,
+	check func(int, *http.Request),
+) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i, res := range script {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err == nil && check != nil {
+				check(i, req)
+			}
+
+			conn.Write([]byte(res))
+			conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func TestDialOptions(t *testing.T) {
+	const switched = "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"\r\n"
+
+	t.Run("Headers, auth and cookies", func(t *testing.T) {
+		var got *http.Request
+
+		l := scriptedServer(t, []string{
+			"HTTP/1.1 101 Switching Protocols\r\n" +
+				"Set-Cookie: a=1\r\n" +
+				"Set-Cookie: b=2\r\n" +
+				"\r\n",
+		}, func(_ int, r *http.Request) {
+			got = r
+		})
+		defer l.Close()
+
+		jar, _ := cookiejar.New(nil)
+		u := &url.URL{Scheme: "http", Host: l.Addr().String()}
+		jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "xyz"}})
+
+		c, err := ws.Dial("ws://bob:secret@"+l.Addr().String()+"/chat?x=1", ws.ClientConfig{
+			Headers: map[string]string{"X-Trace-Id": "abc"},
+			Jar:     jar,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Conn.Close()
+
+		if exp := "/chat?x=1"; got.RequestURI != exp {
+			t.Errorf("URI: exp %q, got %q\n", exp, got.RequestURI)
+		}
+		if exp := "abc"; got.Header.Get("X-Trace-Id") != exp {
+			t.Errorf("X-Trace-Id: exp %q, got %q\n", exp, got.Header.Get("X-Trace-Id"))
+		}
+		if user, pass, ok := got.BasicAuth(); !ok || user != "bob" || pass != "secret" {
+			t.Errorf("BasicAuth: exp (bob, secret), got (%s, %s)\n", user, pass)
+		}
+		if ck, err := got.Cookie("session"); err != nil || ck.Value != "xyz" {
+			t.Errorf("Cookie: exp xyz, got %v\n", err)
+		}
+		if exp, got := 3, len(jar.Cookies(u)); exp != got {
+			t.Errorf("jar: exp %d cookies, got %d\n", exp, got)
+		}
+	})
+
+	t.Run("Follows redirects", func(t *testing.T) {
+		paths := make([]string, 0, 3)
+
+		l := scriptedServer(t, []string{
+			"HTTP/1.1 301 Moved Permanently\r\nLocation: /one\r\n\r\n",
+			"HTTP/1.1 307 Temporary Redirect\r\nLocation: /two\r\n\r\n",
+			switched,
+		}, func(_ int, r *http.Request) {
+			paths = append(paths, r.RequestURI)
+		})
+		defer l.Close()
+
+		c, err := ws.Dial("ws://"+l.Addr().String()+"/", ws.ClientConfig{
+			MaxRedirects: 2,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Conn.Close()
+
+		if exp := []string{"/", "/one", "/two"}; !slices.Equal(exp, paths) {
+			t.Errorf("exp %v, got %v\n", exp, paths)
+		}
+		if exp := "/two"; c.Path != exp {
+			t.Errorf("exp %q, got %q\n", exp, c.Path)
+		}
+	})
+
+	t.Run("Drops credentials on another host", func(t *testing.T) {
+		var reqs []*http.Request
+
+		l := scriptedServer(t, []string{
+			"HTTP/1.1 301 Moved Permanently\r\nLocation: ws://a.test/one\r\n\r\n",
+			"HTTP/1.1 301 Moved Permanently\r\nLocation: ws://b.test/two\r\n\r\n",
+			switched,
+		}, func(_ int, r *http.Request) {
+			reqs = append(reqs, r)
+		})
+		defer l.Close()
+
+		c, err := ws.Dial("ws://bob:secret@a.test/", ws.ClientConfig{
+			MaxRedirects: 2,
+			Headers:      map[string]string{"Cookie": "session=xyz", "X-Trace": "1"},
+			NetDial: func(string, string) (net.Conn, error) {
+				return net.Dial("tcp", l.Addr().String())
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Conn.Close()
+
+		if len(reqs) != 3 {
+			t.Fatalf("exp 3 requests, got %d\n", len(reqs))
+		}
+
+		for i, r := range reqs {
+			_, _, auth := r.BasicAuth()
+			cookie := r.Header.Get("Cookie") != ""
+			same := i < 2
+
+			if exp := map[bool]string{true: "a.test", false: "b.test"}[same]; r.Host != exp {
+				t.Errorf("%d: exp Host %s, got %s\n", i, exp, r.Host)
+			}
+			if auth != same || cookie != same {
+				t.Errorf("%d: exp credentials %t, got (%t, %t)\n", i, same, auth, cookie)
+			}
+			if r.Header.Get("X-Trace") != "1" {
+				t.Errorf("%d: exp X-Trace kept\n", i)
+			}
+		}
+	})
+
+	t.Run("Closes the redirected conn on failure", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		closed := make(chan error, 1)
+
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			http.ReadRequest(r)
+
+			// a wss:// redirect fails the TLS handshake
+			conn.Write([]byte("HTTP/1.1 301 Moved Permanently\r\n" +
+				"Location: wss://" + l.Addr().String() + "/\r\n\r\n"))
+
+			if next, err := l.Accept(); err == nil {
+				next.Close()
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.Copy(io.Discard, r)
+			closed <- err
+		}()
+
+		_, err = ws.Dial("ws://"+l.Addr().String()+"/", ws.ClientConfig{MaxRedirects: 1})
+		if err == nil {
+			t.Fatalf("exp redirect to fail\n")
+		}
+
+		if err := <-closed; err != nil {
+			t.Errorf("exp first conn closed, got %v\n", err)
+		}
+	})
+
+	t.Run("Rejects beyond MaxRedirects", func(t *testing.T) {
+		l := scriptedServer(t, []string{
+			"HTTP/1.1 301 Moved Permanently\r\nLocation: /one\r\n\r\n",
+			"HTTP/1.1 302 Found\r\n" +
+				"Location: /two\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"moved",
+		}, nil)
+		defer l.Close()
+
+		_, err := ws.Dial("ws://"+l.Addr().String()+"/", ws.ClientConfig{
+			MaxRedirects: 1,
+		})
+
+		var herr *ws.HandshakeError
+		if !errors.As(err, &herr) || !errors.Is(err, ws.ErrHandshakeFailed) {
+			t.Errorf("exp *HandshakeError, got %v\n", err)
+			return
+		}
+		if herr.StatusCode != "302" || string(herr.Body) != "moved" {
+			t.Errorf("exp (302, moved), got (%s, %s)\n", herr.StatusCode, herr.Body)
+		}
+	})
+
+	t.Run("Reports status and body", func(t *testing.T) {
+		l := scriptedServer(t, []string{
+			"HTTP/1.1 403 Forbidden\r\n" +
+				"Content-Length: 12\r\n" +
+				"\r\n" +
+				"bad ticket\r\n",
+		}, nil)
+		defer l.Close()
+
+		_, err := ws.Dial("ws://"+l.Addr().String()+"/", ws.ClientConfig{})
+
+		var herr *ws.HandshakeError
+		if !errors.As(err, &herr) {
+			t.Errorf("exp *HandshakeError, got %v\n", err)
+			return
+		}
+		if herr.StatusCode != "403" || string(herr.Body) != "bad ticket\r\n" {
+			t.Errorf("exp (403, bad ticket), got (%s, %q)\n", herr.StatusCode, herr.Body)
+		}
+	})
+}
+
+// connectProxy runs an in-process HTTP CONNECT proxy, requiring
+// the given Proxy-Authorization value if auth is non-empty
+func connectProxy(t *testing.T, auth string, tunnels *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			req, err := http.ReadRequest(r)
+			if err != nil || req.Method != "CONNECT" {
+				conn.Close()
+				continue
+			}
+
+			if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				conn.Close()
+				continue
+			}
+
+			upstream, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				conn.Close()
+				continue
+			}
+
+			tunnels.Add(1)
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+			go func() {
+				io.Copy(upstream, r)
+				upstream.Close()
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestDialProxy(t *testing.T) {
+	const switched = "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"\r\n"
+
+	t.Run("Tunnels with auth", func(t *testing.T) {
+		var host string
+
+		target := scriptedServer(t, []string{switched}, func(_ int, r *http.Request) {
+			host = r.Host
+		})
+		defer target.Close()
+
+		var tunnels atomic.Int32
+		proxy := connectProxy(t, "Basic dXNlcjpwYXNz", &tunnels)
+		defer proxy.Close()
+
+		c, err := ws.Dial("ws://"+target.Addr().String()+"/", ws.ClientConfig{
+			Proxy: ws.ProxyURL(&url.URL{
+				Scheme: "http",
+				Host:   proxy.Addr().String(),
+				User:   url.UserPassword("user", "pass"),
+			}),
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Conn.Close()
+
+		if exp, got := int32(1), tunnels.Load(); got != exp {
+			t.Errorf("exp %d tunnels, got %d\n", exp, got)
+		}
+		if exp := target.Addr().String(); host != exp {
+			t.Errorf("Host: exp %q, got %q\n", exp, host)
+		}
+	})
+
+	t.Run("Proxy rejects", func(t *testing.T) {
+		var tunnels atomic.Int32
+		proxy := connectProxy(t, "Basic dXNlcjpwYXNz", &tunnels)
+		defer proxy.Close()
+
+		_, err := ws.Dial("ws://127.0.0.1:1/", ws.ClientConfig{
+			Proxy: ws.ProxyURL(&url.URL{
+				Scheme: "http",
+				Host:   proxy.Addr().String(),
+			}),
+		})
+		if !errors.Is(err, ws.ErrProxyFailed) {
+			t.Errorf("exp %v, got %v\n", ws.ErrProxyFailed, err)
+		}
+	})
+
+	t.Run("Environment", func(t *testing.T) {
+		t.Setenv("HTTP_PROXY", "http://proxy.internal:3128")
+		t.Setenv("NO_PROXY", "example.org")
+		t.Setenv("HTTPS_PROXY", "")
+		t.Setenv("https_proxy", "")
+
+		u, _ := url.Parse("ws://example.com/chat")
+		p, err := ws.ProxyFromEnvironment(u)
+		if err != nil || p == nil || p.Host != "proxy.internal:3128" {
+			t.Errorf("exp proxy.internal:3128, got (%v, %v)\n", p, err)
+		}
+
+		for _, raw := range []string{
+			"ws://example.org/chat",
+			"ws://api.example.org/chat",
+			"ws://127.0.0.1:9000/",
+			"ws://:9001/",
+			"wss://example.com/chat",
+		} {
+			u, _ = url.Parse(raw)
+			if p, err = ws.ProxyFromEnvironment(u); err != nil || p != nil {
+				t.Errorf("%s: exp no proxy, got (%v, %v)\n", raw, p, err)
+			}
+		}
+	})
+}
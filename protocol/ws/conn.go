@@ -2,34 +2,261 @@ package ws
 
 import (
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/willmroliver/wsgo/container"
 	"github.com/willmroliver/wsgo/core"
 	"github.com/willmroliver/wsgo/protocol/http1"
 )
 
 const (
-	ProtocolGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	ProtocolGUID   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	DefaultBufSize = 0x1000
+
+	// DefaultHandshakeTimeout bounds an opening handshake when
+	// ServerConfig.HandshakeTimeout is unset
+	DefaultHandshakeTimeout = 10 * time.Second
 )
 
+var ErrBufSize = errors.New("buffer size must be a power of two")
+
+// bufPool lends read buffers to connections with SharedBufs
+var bufPool container.Pool[byte]
+
 type Conn struct {
-	*net.TCPConn
+	net.Conn
 	ConnID uint
 	Server core.Server
 
-	buf  core.Buf
-	open bool
+	buf   core.Buf
+	queue *writeQueue
+	wl    writeLock
+	open  atomic.Bool
+
+	// remote is the client address recovered by Server.Conf.Proxy
+	remote net.Addr
+
+	// rate limits the frames read, per Server.Conf.Rate
+	rate *rateLimit
+
+	// claims were verified by Server.Conf.Auth
+	claims Claims
+
+	// limitKey is counted against Server.Limits while admitted
+	limitKey netip.Prefix
+	admitted bool
+
+	// fd is the socket registered with the server's event loop, and
+	// raw reads it without blocking
+	fd  int
+	raw syscall.RawConn
+
+	// inbox holds messages waiting for the server's dispatcher
+	inbox inbox
 }
 
 func (c *Conn) Close() error {
-	if c.Server != nil && c.open {
+	return c.closeWith(0, "")
+}
+
+// closeWith closes c, sending a close frame with status, or with
+// no status if it is 0, if the handshake completed. Only the first
+// of concurrent calls sends the frame.
+func (c *Conn) closeWith(status uint16, reason string) error {
+	if c.Server != nil {
 		c.Server.Close(c)
-		CloseFrame.Encode(c)
 	}
 
-	return c.TCPConn.Close()
+	if c.open.CompareAndSwap(true, false) {
+		if status == 0 && reason == "" {
+			CloseFrame.Encode(c)
+		} else {
+			NewCloseFrame(status, reason).Encode(c)
+		}
+	}
+
+	if c.queue != nil {
+		c.queue.close()
+	}
+
+	return c.Conn.Close()
+}
+
+// Write sends p as a single unit, or queues it when the connection
+// has a write queue. It is safe for concurrent use, but p must hold
+// whole frames: prefer Message.Encode.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.wl.msg.Lock()
+	defer c.wl.msg.Unlock()
+
+	c.wl.lock(false)
+	defer c.wl.unlock()
+
+	if err = c.writeFrame(OpcodeCont, p); err == nil {
+		n = len(p)
+	}
+
+	return
+}
+
+func (c *Conn) writeLock() *writeLock {
+	return &c.wl
+}
+
+func (c *Conn) writeFrame(op byte, p []byte) (err error) {
+	if c.queue != nil {
+		_, err = c.queue.push(p)
+		return
+	}
+
+	_, err = c.Conn.Write(p)
+	return
+}
+
+func (c *Conn) writeBuffers(op byte, bufs net.Buffers) (err error) {
+	if c.queue != nil {
+		_, err = c.queue.push(bufs...)
+		return
+	}
+
+	_, err = bufs.WriteTo(c.Conn)
+	return
+}
+
+// checkHeader applies c's rate limit to each frame read, closing c
+// with 1008 (policy violation) if the limit's action requires
+func (c *Conn) checkHeader(h *FrameHeader) (skip bool, err error) {
+	if c.rate == nil {
+		return
+	}
+
+	if skip, err = c.rate.check(h); err != nil {
+		c.closeWith(StatusCodePolicyViolated, "rate limit exceeded")
+	}
+
+	return
+}
+
+// QueueDepth returns the number of frames waiting in the write
+// queue: a persistently high depth indicates a slow consumer
+func (c *Conn) QueueDepth() int {
+	if c.queue == nil {
+		return 0
+	}
+	return c.queue.depth()
+}
+
+// QueueDropped returns the number of frames discarded by the
+// write queue's drop policy
+func (c *Conn) QueueDropped() uint64 {
+	if c.queue == nil {
+		return 0
+	}
+	return c.queue.dropped.Load()
+}
+
+// WrapConn returns a server-side Conn reading from any net.Conn,
+// which must then complete Handshake before exchanging frames
+func WrapConn(conn net.Conn) *Conn {
+	c, _ := NewConn(conn, ServerConfig{})
+	return c
+}
+
+// NewConn returns a server-side Conn as WrapConn does, applying the
+// buffer and write queue settings in conf, or ErrBufSize if
+// conf.ConnBufSize is invalid
+func NewConn(conn net.Conn, conf ServerConfig) (*Conn, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	setWriteBuffer(conn, conf.WriteBufSize)
+
+	c := &Conn{Conn: conn, rate: newRateLimit(conf.Rate)}
+
+	if conf.SharedBufs {
+		c.buf = core.NewPooledRingBuf(bufSize(conf.ConnBufSize), conn, &bufPool)
+	} else {
+		c.buf = core.NewRingBuf(bufSize(conf.ConnBufSize), conn)
+	}
+
+	if conf.Queue.Size > 0 {
+		c.queue = newWriteQueue(conn, conf.Queue, func() { c.closeWith(0, "") })
+	}
+
+	return c, nil
+}
+
+// SetBufSize resizes the read buffer, e.g. to grow it for a burst
+// of large frames, keeping any bytes already buffered
+func (c *Conn) SetBufSize(size uint) error {
+	return resizeBuf(c.buf, size)
+}
+
+func bufSize(size uint) uint {
+	if size == 0 {
+		return DefaultBufSize
+	}
+	return size
+}
+
+func checkBufSize(size uint) error {
+	if size != 0 && !container.ValidSize(size) {
+		return ErrBufSize
+	}
+	return nil
+}
+
+func resizeBuf(b core.Buf, size uint) error {
+	if err := checkBufSize(size); err != nil {
+		return err
+	}
+
+	r, ok := b.(interface{ Resize(uint) error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	return r.Resize(bufSize(size))
+}
+
+// isClient reports whether frames written to c must be masked
+func isClient(c core.Conn) bool {
+	_, ok := c.(*ClientConn)
+	return ok
+}
+
+// setWriteBuffer sizes the socket send buffer, where supported
+func setWriteBuffer(conn net.Conn, size int) {
+	if size <= 0 {
+		return
+	}
+
+	if w, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+		w.SetWriteBuffer(size)
+	}
+}
+
+// NetConn returns the underlying network connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the client address recovered from a trusted
+// proxy during the handshake, or else the peer's address
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
 }
 
 func (c *Conn) Buf() core.Buf {
@@ -37,73 +264,170 @@ func (c *Conn) Buf() core.Buf {
 }
 
 func (c *Conn) Open() bool {
-	return c.open
+	return c.open.Load()
 }
 
 func (c *Conn) Handshake() (err error) {
+	var conf ServerConfig
+	s, _ := c.Server.(*Server)
+	if s != nil {
+		conf = s.Conf
+	}
+
+	// a stalled peer must not hold its handshake open
+	timeout := conf.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	if conf.Proxy.Protocol {
+		if c.remote, err = c.readProxyHeader(&conf.Proxy); err != nil {
+			c.Close()
+			return
+		}
+	}
+
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		if err = tc.Handshake(); err != nil {
+			c.Close()
+			return
+		}
+	}
+
 	h := http1.NewMessage()
 	if err = h.Decode(c); err != nil {
 		c.Close()
 		return
 	}
 
-	uri := ""
-	s, ok := c.Server.(*Server)
-	if s != nil && ok {
-		uri = s.Conf.Path
+	accept, err := checkUpgrade(h.Method, h.Protocol, h.URI, conf.Path, h.Get)
+	if err != nil {
+		return
+	}
+
+	path, _, _ := strings.Cut(h.URI, "?")
+	c.rate = newRateLimit(conf.rateConfig(path))
+
+	if conf.Proxy.Headers {
+		if addr := forwardedAddr(&conf.Proxy, c.RemoteAddr(), h.Values); addr != nil {
+			c.remote = addr
+		}
+	}
+
+	if s != nil {
+		if err = s.admit(c); err != nil {
+			return
+		}
+	}
+
+	var protocol string
+	if conf.Auth != nil {
+		if c.claims, protocol, err = conf.Auth.authenticate(h.URI, h.Get); err != nil {
+			reject(c, "401 Unauthorized", nil)
+			return
+		}
+	}
+
+	if conf.OnHandshake != nil {
+		if err = conf.OnHandshake(c, h.URI, h.Get); err != nil {
+			reject(c, "403 Forbidden", nil)
+			return
+		}
+	}
+
+	h.ParseStatusLine("HTTP/1.1 101 Switching Protocols")
+
+	h.Headers = map[string]string{
+		"Upgrade":              "websocket",
+		"Connection":           "Upgrade",
+		"Sec-Websocket-Accept": accept,
+	}
+	if protocol != "" {
+		h.Headers["Sec-WebSocket-Protocol"] = protocol
+	}
+
+	err = h.Encode(c)
+	c.open.Store(err == nil)
+	return
+}
+
+// reject responds to a handshake request with an error status and
+// any extra headers, before the connection is closed
+func reject(c *Conn, status string, headers map[string]string) {
+	h := http1.NewMessage()
+	h.ParseStatusLine("HTTP/1.1 " + status)
+
+	for k, v := range headers {
+		h.Headers[k] = v
 	}
+	h.Headers["Content-Length"] = "0"
+	h.Headers["Connection"] = "close"
 
-	if h.Method != "GET" {
+	h.Encode(c)
+}
+
+// checkUpgrade validates an opening handshake request, returning
+// the Sec-WebSocket-Accept value for the response. The path of the
+// request target, without its query, must be uri if it is non-empty.
+func checkUpgrade(
+	method, protocol, target, uri string,
+	header func(string) string,
+) (accept string, err error) {
+	if method != "GET" {
 		err = errors.New("invalid method, expecting GET")
 		return
 	}
 
-	if len(h.Protocol) != 8 ||
-		h.Protocol[:7] != "HTTP/1." ||
-		h.Protocol[7] < '1' ||
-		h.Protocol[7] > '3' {
+	if len(protocol) != 8 ||
+		protocol[:7] != "HTTP/1." ||
+		protocol[7] < '1' ||
+		protocol[7] > '3' {
 		err = errors.New("invalid protocol, expecting HTTP/1.x")
 		return
 	}
 
-	if uri != "" && h.URI != uri {
+	if path, _, _ := strings.Cut(target, "?"); uri != "" && path != uri {
 		err = errors.New("invalid URI in header")
 		return
 	}
 
-	if h.Headers["Upgrade"] != "websocket" {
+	if !hasToken(header("Upgrade"), "websocket") {
 		err = errors.New(
 			"invalid header 'Upgrade', expecting 'websocket'",
 		)
 		return
 	}
 
-	if h.Headers["Connection"] != "Upgrade" {
+	if !hasToken(header("Connection"), "Upgrade") {
 		err = errors.New(
 			"invalid header 'Connection', expecting 'Upgrade'",
 		)
 		return
 	}
 
-	if h.Headers["Sec-WebSocket-Version"] != "13" {
+	if header("Sec-WebSocket-Version") != "13" {
 		err = errors.New(
 			"invalid header 'Sec-WebSocket-Version', expecting '13'",
 		)
 		return
 	}
 
-	key := h.Headers["Sec-Websocket-Key"]
+	key := header("Sec-WebSocket-Key")
 	checksum := sha1.Sum([]byte(key + ProtocolGUID))
+	accept = base64.StdEncoding.EncodeToString(checksum[:])
+	return
+}
 
-	h.ParseStatusLine("HTTP/1.1 101 Switching Protocols")
-
-	h.Headers = map[string]string{
-		"Upgrade":              "websocket",
-		"Connection":           "Upgrade",
-		"Sec-Websocket-Accept": base64.StdEncoding.EncodeToString(checksum[:]),
+// hasToken reports whether a comma-separated header value
+// contains token, ignoring case
+func hasToken(value, token string) bool {
+	for v := range strings.SplitSeq(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
 	}
-
-	err = h.Encode(c)
-	c.open = err == nil
-	return
+	return false
 }
@@ -0,0 +1,132 @@
+package ws
+
+import "sync"
+
+// DispatchConfig runs the Handler on a pool of Workers goroutines
+// when Workers is positive, instead of on the goroutine reading
+// each connection.
+//
+// Messages from one connection are handled in order, one at a
+// time, while different connections are handled in parallel. At
+// most Pending messages (default 16 per worker) wait across all
+// connections: beyond that, reading pauses until workers catch up.
+type DispatchConfig struct {
+	Workers int
+	Pending int
+}
+
+// dispatcher hands messages to workers through per-connection
+// inboxes. A connection is in ready at most once, while it has
+// messages waiting and no worker is handling it.
+type dispatcher struct {
+	h     Handler
+	slots chan struct{}
+	ready chan *Conn
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type inbox struct {
+	mu        sync.Mutex
+	msgs      []*Message
+	scheduled bool
+}
+
+var msgPool = sync.Pool{
+	New: func() any {
+		return new(Message)
+	},
+}
+
+func newDispatcher(h Handler, conf DispatchConfig) *dispatcher {
+	pending := conf.Pending
+	if pending <= 0 {
+		pending = 16 * conf.Workers
+	}
+
+	// each scheduled connection holds at least one slot,
+	// so sends to ready never block
+	d := &dispatcher{
+		h:     h,
+		slots: make(chan struct{}, pending),
+		ready: make(chan *Conn, pending),
+		done:  make(chan struct{}),
+	}
+
+	d.wg.Add(conf.Workers)
+	for range conf.Workers {
+		go d.work()
+	}
+
+	return d
+}
+
+// push queues a copy of m for c, blocking while Pending messages
+// are already waiting
+func (d *dispatcher) push(c *Conn, m *Message) {
+	select {
+	case d.slots <- struct{}{}:
+	case <-d.done:
+		return
+	}
+
+	dm := msgPool.Get().(*Message)
+	dm.FrameHeader = m.FrameHeader
+	dm.Payload = append(dm.Payload[:0], m.Payload...)
+
+	in := &c.inbox
+	in.mu.Lock()
+	in.msgs = append(in.msgs, dm)
+	schedule := !in.scheduled
+	in.scheduled = true
+	in.mu.Unlock()
+
+	if schedule {
+		d.ready <- c
+	}
+}
+
+func (d *dispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case c := <-d.ready:
+			d.drain(c)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// drain handles the messages waiting for c when it was scheduled,
+// then reschedules c behind other connections if more have arrived
+func (d *dispatcher) drain(c *Conn) {
+	in := &c.inbox
+
+	in.mu.Lock()
+	msgs := in.msgs
+	in.msgs = nil
+	in.mu.Unlock()
+
+	for _, m := range msgs {
+		d.h.OnMessage(c, m)
+		msgPool.Put(m)
+		<-d.slots
+	}
+
+	in.mu.Lock()
+	more := len(in.msgs) > 0
+	in.scheduled = more
+	in.mu.Unlock()
+
+	if more {
+		d.ready <- c
+	}
+}
+
+// close stops the workers once their current messages are handled
+func (d *dispatcher) close() {
+	close(d.done)
+	d.wg.Wait()
+}
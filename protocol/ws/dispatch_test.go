@@ -0,0 +1,120 @@
+package ws_test
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func TestDispatchOrder(t *testing.T) {
+	const clients, msgs = 4, 50
+
+	var (
+		mu       sync.Mutex
+		seen     = make(map[*ws.Conn][]int)
+		total    sync.WaitGroup
+		running  atomic.Int32
+		parallel atomic.Int32
+	)
+
+	total.Add(clients * msgs)
+
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Dispatch = ws.DispatchConfig{Workers: 4}
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			if n := running.Add(1); n > parallel.Load() {
+				parallel.Store(n)
+			}
+			time.Sleep(100 * time.Microsecond)
+			running.Add(-1)
+
+			i, _ := strconv.Atoi(string(m.Payload))
+
+			mu.Lock()
+			seen[c] = append(seen[c], i)
+			mu.Unlock()
+
+			total.Done()
+		})
+	})
+
+	for range clients {
+		c, err := ws.Dial(url, ws.ClientConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Conn.Close()
+
+		go func() {
+			for i := range msgs {
+				m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte(strconv.Itoa(i)))
+				m.FIN = true
+				m.Encode(c)
+			}
+		}()
+	}
+
+	total.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, got := range seen {
+		for i, n := range got {
+			if i != n {
+				t.Fatalf("exp messages in order, got %v\n", got)
+			}
+		}
+	}
+
+	if parallel.Load() < 2 {
+		t.Errorf("exp connections handled in parallel\n")
+	}
+}
+
+func TestDispatchBackpressure(t *testing.T) {
+	release := make(chan struct{})
+
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Dispatch = ws.DispatchConfig{Workers: 1, Pending: 2}
+		s.Handler = ws.HandlerFunc(func(*ws.Conn, *ws.Message) {
+			<-release
+		})
+	})
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	for range 5 {
+		m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("x"))
+		m.FIN = true
+		m.Encode(c)
+	}
+
+	ping := ws.NewMessage(ws.OpcodePing)
+	ping.FIN = true
+	ping.Encode(c)
+
+	// reading has paused behind the saturated pool, so the ping
+	// is not answered until the handler is released
+	m := new(ws.Message)
+
+	c.Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := m.Decode(c); err == nil {
+		t.Fatalf("exp no pong while saturated, got opcode %d\n", m.Opcode)
+	}
+
+	close(release)
+
+	c.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := m.Decode(c); err != nil || m.Opcode != ws.OpcodePong {
+		t.Errorf("exp pong once released, got opcode %d (%v)\n", m.Opcode, err)
+	}
+}
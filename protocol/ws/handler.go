@@ -0,0 +1,71 @@
+package ws
+
+// Handler receives the data frames read from server connections.
+// Frames from one connection are always handled in order, one at
+// a time.
+//
+// m, and its payload, are reused for the next frame read once
+// OnMessage returns: copy anything which must be retained.
+type Handler interface {
+	OnMessage(c *Conn, m *Message)
+}
+
+type HandlerFunc func(c *Conn, m *Message)
+
+func (f HandlerFunc) OnMessage(c *Conn, m *Message) {
+	f(c, m)
+}
+
+// serve reads frames from c once its handshake completes, on the
+// event loop if s.Poll enables one, or else on a new goroutine
+func (s *Server) serve(c *Conn) {
+	if s.Handler == nil {
+		return
+	}
+
+	if s.poller != nil && s.poller.add(c) == nil {
+		return
+	}
+
+	go s.readLoop(c)
+}
+
+func (s *Server) readLoop(c *Conn) {
+	m := new(Message)
+
+	for m.DecodeUnmasked(c) == nil {
+		if !s.handle(c, m) {
+			return
+		}
+	}
+
+	c.Close()
+}
+
+// handle responds to control frames and passes data frames to
+// s.Handler, returning false once c has been closed
+func (s *Server) handle(c *Conn, m *Message) bool {
+	switch m.Opcode {
+	case OpcodeClose:
+		status := m.CloseStatus()
+		if status == StatusCodeNoStatus {
+			status = 0
+		}
+
+		c.closeWith(status, "")
+		return false
+	case OpcodePing:
+		pong := NewMessage(OpcodePong).SetPayload(m.Payload)
+		pong.FIN = true
+		pong.Encode(c)
+	case OpcodePong:
+	default:
+		if s.dispatcher != nil {
+			s.dispatcher.push(c, m)
+		} else {
+			s.Handler.OnMessage(c, m)
+		}
+	}
+
+	return true
+}
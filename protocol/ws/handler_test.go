@@ -0,0 +1,93 @@
+package ws_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// runServer runs a Server on a loopback port, configured by set
+// before it starts
+func runServer(t *testing.T, set func(s *ws.Server)) (*ws.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ws.NewServerListener(l)
+	set(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+
+	t.Cleanup(func() {
+		cancel()
+		l.Close()
+	})
+
+	return s, "ws://" + l.Addr().String() + "/"
+}
+
+// echoServer runs a Server which echoes each data frame back
+func echoServer(t *testing.T, poll ws.PollConfig) string {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Poll = poll
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			reply := ws.NewMessage(m.Opcode).SetPayload(m.Payload)
+			reply.FIN = m.FIN
+			reply.Encode(c)
+		})
+	})
+
+	return url
+}
+
+func echo(c *ws.ClientConn, payload []byte) error {
+	m := ws.NewMessage(ws.OpcodeBinary).SetPayload(payload)
+	m.FIN = true
+	if err := m.Encode(c); err != nil {
+		return err
+	}
+
+	if err := m.Decode(c); err != nil {
+		return err
+	}
+	if m.Opcode != ws.OpcodeBinary || !bytes.Equal(m.Payload, payload) {
+		return ws.ErrBadFrame
+	}
+
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	url := echoServer(t, ws.PollConfig{})
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	for _, n := range []int{1, 0x200, 0x3000} {
+		if err := echo(c, bytes.Repeat([]byte{'x'}, n)); err != nil {
+			t.Errorf("echo %d bytes: %v\n", n, err)
+		}
+	}
+
+	ping := ws.NewMessage(ws.OpcodePing).SetPayload([]byte("hb"))
+	ping.FIN = true
+	ping.Encode(c)
+
+	m := new(ws.Message)
+	if err := m.Decode(c); err != nil || m.Opcode != ws.OpcodePong || string(m.Payload) != "hb" {
+		t.Errorf("exp pong %q, got opcode %d %q (%v)\n", "hb", m.Opcode, m.Payload, err)
+	}
+
+	ws.NewCloseFrame(ws.StatusCodeNormalClosure, "").Encode(c)
+	if err := m.Decode(c); err != nil || m.CloseStatus() != ws.StatusCodeNormalClosure {
+		t.Errorf("exp close 1000, got opcode %d status %d (%v)\n", m.Opcode, m.CloseStatus(), err)
+	}
+}
@@ -0,0 +1,221 @@
+package ws
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrLimited = errors.New("connection limit reached")
+
+// LimitConfig bounds the connections a Server upgrades, where each
+// positive field applies.
+//
+// MaxConns caps open connections, and MaxConnsPerIP those from one
+// client address, or one /64 for IPv6, as reported by RemoteAddr.
+// HandshakeRate caps the handshakes per second from one address,
+// allowing bursts of up to HandshakeBurst (default 1).
+//
+// Requests over a limit get 503 Service Unavailable, with a
+// Retry-After of RetryAfter (default 1s) or until the handshake rate
+// allows another.
+type LimitConfig struct {
+	MaxConns       int
+	MaxConnsPerIP  int
+	HandshakeRate  float64
+	HandshakeBurst int
+	RetryAfter     time.Duration
+}
+
+// limiter counts the connections admitted by a Server
+type limiter struct {
+	mu      sync.Mutex
+	total   int
+	ips     map[netip.Prefix]*ipLimit
+	pruneAt int
+}
+
+type ipLimit struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+const minPruneAt = 0x400
+
+// admit counts a connection from key, or returns how long the
+// client should wait before retrying if a limit is reached. key is
+// invalid where the client has no IP address.
+func (l *limiter) admit(
+	conf *LimitConfig,
+	key netip.Prefix,
+	now time.Time,
+) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wait = conf.RetryAfter
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	if conf.MaxConns > 0 && l.total >= conf.MaxConns {
+		return
+	}
+
+	if key.IsValid() {
+		ip := l.ip(conf, key, now)
+
+		if conf.MaxConnsPerIP > 0 && ip.conns >= conf.MaxConnsPerIP {
+			return
+		}
+
+		if conf.HandshakeRate > 0 {
+			if ip.tokens < 1 {
+				need := (1 - ip.tokens) / conf.HandshakeRate
+				return max(wait, time.Duration(need*float64(time.Second))), false
+			}
+			ip.tokens--
+		}
+
+		ip.conns++
+	}
+
+	l.total++
+	return 0, true
+}
+
+// ip returns the entry for key, refilling its handshake tokens
+func (l *limiter) ip(conf *LimitConfig, key netip.Prefix, now time.Time) *ipLimit {
+	if l.ips == nil {
+		l.ips = make(map[netip.Prefix]*ipLimit)
+	}
+
+	if len(l.ips) >= max(l.pruneAt, minPruneAt) {
+		l.prune(conf, now)
+	}
+
+	burst := float64(max(conf.HandshakeBurst, 1))
+
+	ip := l.ips[key]
+	if ip == nil {
+		ip = &ipLimit{tokens: burst, last: now}
+		l.ips[key] = ip
+	}
+
+	ip.tokens = min(burst, ip.tokens+now.Sub(ip.last).Seconds()*conf.HandshakeRate)
+	ip.last = now
+	return ip
+}
+
+// prune forgets addresses with no connections and a full bucket,
+// which are indistinguishable from new ones
+func (l *limiter) prune(conf *LimitConfig, now time.Time) {
+	burst := float64(max(conf.HandshakeBurst, 1))
+
+	for key, ip := range l.ips {
+		tokens := ip.tokens + now.Sub(ip.last).Seconds()*conf.HandshakeRate
+		if ip.conns == 0 && (tokens >= burst || conf.HandshakeRate <= 0) {
+			delete(l.ips, key)
+		}
+	}
+
+	l.pruneAt = 2 * len(l.ips)
+}
+
+// release uncounts a connection admitted from key
+func (l *limiter) release(key netip.Prefix) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+
+	if ip := l.ips[key]; ip != nil {
+		ip.conns--
+	}
+}
+
+// limitKey groups client addresses which share a per-IP limit
+func limitKey(ip netip.Addr) netip.Prefix {
+	if !ip.IsValid() {
+		return netip.Prefix{}
+	}
+
+	ip = ip.Unmap()
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, 32)
+	}
+
+	p, _ := ip.Prefix(64)
+	return p
+}
+
+// admit counts c against s.Limits, once its client address is
+// known, responding 503 Service Unavailable if a limit is reached
+func (s *Server) admit(c *Conn) error {
+	ip, _ := addrIP(c.RemoteAddr())
+	key := limitKey(ip)
+
+	s.mu.RLock()
+	conf := s.Limits
+	s.mu.RUnlock()
+
+	wait, ok := s.limits.admit(&conf, key, time.Now())
+	if !ok {
+		reject(c, "503 Service Unavailable", map[string]string{
+			"Retry-After": strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+		})
+		return ErrLimited
+	}
+
+	s.mu.Lock()
+	c.limitKey, c.admitted = key, true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SetLimits replaces s.Limits while s runs. Connections beyond a
+// lowered MaxConns or MaxConnsPerIP are closed, newest first, with
+// status 1013 (try again later).
+func (s *Server) SetLimits(conf LimitConfig) {
+	s.mu.Lock()
+	s.Limits = conf
+
+	conns := make([]*Conn, 0, len(s.Conns))
+	for _, c := range s.Conns {
+		if c := c.(*Conn); c.admitted {
+			conns = append(conns, c)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(conns, func(a, b *Conn) int {
+		return cmp.Compare(b.ConnID, a.ConnID)
+	})
+
+	perIP := make(map[netip.Prefix]int)
+	for _, c := range conns {
+		perIP[c.limitKey]++
+	}
+
+	total := len(conns)
+
+	for _, c := range conns {
+		overTotal := conf.MaxConns > 0 && total > conf.MaxConns
+		overIP := conf.MaxConnsPerIP > 0 &&
+			c.limitKey.IsValid() &&
+			perIP[c.limitKey] > conf.MaxConnsPerIP
+
+		if overTotal || overIP {
+			total--
+			perIP[c.limitKey]--
+			c.closeWith(StatusCodeTryAgainLater, "")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package ws_test
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func limitServer(t *testing.T, limits ws.LimitConfig) (*ws.Server, string) {
+	return runServer(t, func(s *ws.Server) {
+		s.Limits = limits
+		s.Conf.Proxy = ws.ProxyConfig{
+			Headers: true,
+			Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		}
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			m.Encode(c)
+		})
+	})
+}
+
+// dialFrom dials url as the client forwarded by ip, if set
+func dialFrom(url, ip string) (*ws.ClientConn, error) {
+	conf := ws.ClientConfig{}
+	if ip != "" {
+		conf.Headers = map[string]string{"X-Forwarded-For": ip}
+	}
+	return ws.Dial(url, conf)
+}
+
+// expLimited checks that err is a 503 response asking the client to
+// retry after retry seconds
+func expLimited(t *testing.T, err error, retry string) {
+	t.Helper()
+
+	var herr *ws.HandshakeError
+	if !errors.As(err, &herr) {
+		t.Fatalf("exp handshake rejected, got %v\n", err)
+	}
+	if herr.StatusCode != "503" || herr.Headers["Retry-After"] != retry {
+		t.Errorf("exp 503 with Retry-After %s, got %s %q\n",
+			retry, herr.StatusCode, herr.Headers["Retry-After"])
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	_, url := limitServer(t, ws.LimitConfig{MaxConnsPerIP: 2})
+
+	var conns []*ws.ClientConn
+	for range 2 {
+		c, err := dialFrom(url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+
+	_, err := dialFrom(url, "")
+	expLimited(t, err, "1")
+
+	// other clients, and other /64s, are unaffected
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2", "2001:db8:0:1::1"} {
+		c, err := dialFrom(url, ip)
+		if err != nil {
+			t.Fatalf("%s: %v\n", ip, err)
+		}
+		defer c.Close()
+	}
+
+	_, err = dialFrom(url, "2001:db8::3")
+	expLimited(t, err, "1")
+
+	// closing a connection frees its slot
+	conns[0].Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := dialFrom(url, "")
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("exp slot freed by close, got %v\n", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conns[1].Close()
+}
+
+func TestMaxConns(t *testing.T) {
+	_, url := limitServer(t, ws.LimitConfig{MaxConns: 1, RetryAfter: 30 * time.Second})
+
+	c, err := dialFrom(url, "198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = dialFrom(url, "198.51.100.2")
+	expLimited(t, err, "30")
+}
+
+func TestHandshakeRate(t *testing.T) {
+	_, url := limitServer(t, ws.LimitConfig{HandshakeRate: 0.25, HandshakeBurst: 2})
+
+	for range 2 {
+		c, err := dialFrom(url, "198.51.100.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	_, err := dialFrom(url, "198.51.100.1")
+	expLimited(t, err, "4")
+
+	c, err := dialFrom(url, "198.51.100.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestSetLimits(t *testing.T) {
+	s, url := limitServer(t, ws.LimitConfig{})
+
+	var conns []*ws.ClientConn
+	for range 3 {
+		c, err := dialFrom(url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	// concurrent calls close each connection once
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.SetLimits(ws.LimitConfig{MaxConns: 1})
+		}()
+	}
+	wg.Wait()
+
+	m := new(ws.Message)
+	for _, c := range conns[1:] {
+		closes := 0
+		for m.Decode(c) == nil {
+			if m.Opcode != ws.OpcodeClose || m.CloseStatus() != ws.StatusCodeTryAgainLater {
+				t.Errorf("exp close with 1013, got opcode %d status %d\n", m.Opcode, m.CloseStatus())
+			}
+			closes++
+		}
+		if closes != 1 {
+			t.Errorf("exp 1 close frame, got %d\n", closes)
+		}
+	}
+
+	if err := echo(conns[0], []byte("still open")); err != nil {
+		t.Errorf("exp oldest connection kept, got %v\n", err)
+	}
+
+	_, err := dialFrom(url, "")
+	expLimited(t, err, "1")
+}
@@ -7,8 +7,10 @@ import (
 	"errors"
 	"io"
 	"math"
+	"net"
 	"slices"
 	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/willmroliver/wsgo/core"
@@ -26,21 +28,36 @@ const (
 	StatusCodeGoingAway        = 1001
 	StatusCodeProtocolError    = 1002
 	StatusCodeBadDataType      = 1003
+	StatusCodeNoStatus         = 1005
+	StatusCodeAbnormalClosure  = 1006
 	StatusCodeInconsistentData = 1007
 	StatusCodePolicyViolated   = 1008
 	StatusCodeMessageTooBig    = 1009
 	StatusCodeNeedExtension    = 1010
 	StatusCodeUnexpectedCond   = 1011
+	StatusCodeTryAgainLater    = 1013
 )
 
+// writeBufSize bounds the frames Encode coalesces into one write,
+// and the chunks in which client payloads are masked
+const writeBufSize = 0x1000
+
 var (
 	ErrBadFrame = errors.New("malformed WebSocket frame")
 
 	CloseFrame = NewCloseFrame(0, "")
-	PingFrame  = NewMessage(OpcodePing)
-	PongFrame  = NewMessage(OpcodePong)
+	PingFrame  = newControlFrame(OpcodePing)
+	PongFrame  = newControlFrame(OpcodePong)
 )
 
+// newControlFrame returns an empty control frame: control frames
+// must not be fragmented, so FIN is always set
+func newControlFrame(op byte) *Message {
+	m := NewMessage(op)
+	m.FIN = true
+	return m
+}
+
 type FrameHeader struct {
 	FIN, MASK        bool
 	RSV1, RSV2, RSV3 bool
@@ -49,11 +66,45 @@ type FrameHeader struct {
 	MaskingKey       [4]byte
 }
 
+var writePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, writeBufSize)
+		return &b
+	},
+}
+
 // Message serializes and parses individual
 // WebSocket wire-format frames
 type Message struct {
 	FrameHeader
 	Payload []byte
+
+	// hdr is scratch space for decoding the 2-14 byte header
+	// without allocating
+	hdr [14]byte
+
+	// um tracks the key offset while unmasking across the
+	// read buffer's wrap point
+	um unmasker
+}
+
+type unmasker struct {
+	dst []byte
+	key [4]byte
+	pos int
+}
+
+// funcReader is implemented by read buffers which expose their
+// contents in place, such as core.RingBuf
+type funcReader interface {
+	ReadFunc(func([]byte, any) int, any) int
+}
+
+// headerChecker is implemented by connections which inspect each
+// frame header before its payload is read, reporting frames whose
+// payload should be discarded unread
+type headerChecker interface {
+	checkHeader(h *FrameHeader) (skip bool, err error)
 }
 
 func NewMessage(op byte) *Message {
@@ -70,28 +121,128 @@ func (f *Message) SetPayload(p []byte) *Message {
 }
 
 // Encode writes a serialized WebSocket Protocol frame
-// to the underlying Conn
+// to the underlying Conn.
+//
+// Frames which fit in a pooled write buffer are coalesced into a
+// single write; larger frames send the header and payload together
+// with net.Buffers (writev). On a ClientConn, an unmasked payload is
+// masked with a fresh key while copying into the pooled buffer, so
+// f.Payload is never modified.
+//
+// Encode is safe for concurrent use on a Conn or ClientConn: frames
+// never interleave, and control frames take priority over data.
 func (f *Message) Encode(c core.Conn) error {
-	data, err := f.EncodeBytes()
-	if err != nil {
-		return err
+	l := lockFrame(c, f.Opcode)
+	defer unlockFrame(l, f.Opcode)
+
+	return f.encode(c)
+}
+
+// EncodeFragments writes f as a fragmented message, with each frame
+// carrying at most size bytes of the payload.
+//
+// Other data frames written concurrently wait for the final
+// fragment, while control frames may be sent between fragments.
+func (f *Message) EncodeFragments(c core.Conn, size int) (err error) {
+	if size <= 0 || isControl(f.Opcode) || len(f.Payload) <= size {
+		return f.Encode(c)
+	}
+
+	var l *writeLock
+	if fc, ok := c.(frameConn); ok {
+		l = fc.writeLock()
+		l.msg.Lock()
+		defer l.msg.Unlock()
+	}
+
+	frag := *f
+	frag.FIN = false
+
+	for off := 0; off < len(f.Payload); off += size {
+		end := min(off+size, len(f.Payload))
+		frag.Payload, frag.PL = f.Payload[off:end], end-off
+
+		if off > 0 {
+			frag.Opcode = OpcodeCont
+		}
+		if end == len(f.Payload) {
+			frag.FIN = true
+		}
+
+		if l != nil {
+			l.lock(false)
+		}
+
+		err = frag.encode(c)
+
+		if l != nil {
+			l.unlock()
+		}
+		if err != nil {
+			return
+		}
 	}
 
-	_, err = c.Write(data)
-	return err
+	return
+}
+
+func (f *Message) encode(c core.Conn) (err error) {
+	key := f.MaskingKey
+
+	mask := !f.MASK && isClient(c)
+	if mask {
+		rand.Read(key[:])
+	}
+
+	bp := writePool.Get().(*[]byte)
+	defer writePool.Put(bp)
+
+	buf := *bp
+	n := f.header(buf, f.MASK || mask, key)
+
+	switch {
+	case mask:
+		for off, first := 0, true; first || off < len(f.Payload); first = false {
+			k := maskCopy(buf[n:], f.Payload[off:], key, off)
+			if err = writeFrame(c, f.Opcode, buf[:n+k]); err != nil {
+				return
+			}
+			n, off = 0, off+k
+		}
+	case n+len(f.Payload) <= len(buf):
+		n += copy(buf[n:], f.Payload)
+		err = writeFrame(c, f.Opcode, buf[:n])
+	default:
+		err = writeBuffers(c, f.Opcode, net.Buffers{buf[:n], f.Payload})
+	}
+
+	return
 }
 
 // EncodeBytes serializes a WebSocket Protocol frame in accordance with
 // [RFC6455] and ABNF [RFC5234].
 func (f *Message) EncodeBytes() (data []byte, err error) {
-	var b [2]byte
+	var hdr [14]byte
+
+	n := f.header(hdr[:], f.MASK, f.MaskingKey)
+	data = make([]byte, n+len(f.Payload))
+	copy(data, hdr[:n])
+	copy(data[n:], f.Payload)
+
+	return
+}
+
+// header writes the 2-14 byte frame header into b, returning its
+// length. If mask is set, the MASK bit and key are written.
+func (f *Message) header(b []byte, mask bool, key [4]byte) (n int) {
+	b[0] = f.Opcode
 	if f.FIN {
-		b[0] = 1
+		b[0] |= 1 << 7
 	}
 
-	b[0] = (b[0] << 7) | f.Opcode
-	if f.MASK {
-		b[1] = (1 << 7)
+	b[1] = 0
+	if mask {
+		b[1] = 1 << 7
 	}
 
 	pl := len(f.Payload)
@@ -99,38 +250,21 @@ func (f *Message) EncodeBytes() (data []byte, err error) {
 	switch {
 	case pl > math.MaxUint16:
 		b[1] |= 127
+		binary.BigEndian.PutUint64(b[2:], uint64(pl))
+		n = 10
 	case pl > 125:
 		b[1] |= 126
-	case pl >= 0:
+		binary.BigEndian.PutUint16(b[2:], uint16(pl))
+		n = 4
+	default:
 		b[1] |= byte(pl)
+		n = 2
 	}
 
-	buf := new(bytes.Buffer)
-	buf.Grow(pl + 14)
-	buf.Write(b[:])
-
-	switch {
-	case pl > math.MaxUint16:
-		err = binary.Write(buf, binary.BigEndian, uint64(pl))
-	case pl > 125:
-		err = binary.Write(buf, binary.BigEndian, uint16(pl))
+	if mask {
+		n += copy(b[n:], key[:])
 	}
 
-	if err != nil {
-		return
-	}
-
-	if f.MASK {
-		if _, err = buf.Write(f.MaskingKey[:]); err != nil {
-			return
-		}
-	}
-
-	if _, err = buf.Write(f.Payload); err != nil {
-		return
-	}
-
-	data = buf.Bytes()
 	return
 }
 
@@ -139,14 +273,69 @@ func (f *Message) EncodeBytes() (data []byte, err error) {
 //
 // f.Payload is copied from data, so mutations to data
 // after decoding do not affect f after Decode completes.
+// Its existing capacity is reused, so once warmed up Decode
+// does not allocate: copy a payload before decoding the next
+// frame into f if it must be retained.
 //
 // If f.Payload is masked, Decode sets f.MASK and does not ApplyMask
-func (f *Message) Decode(c core.Conn) (err error) {
+func (f *Message) Decode(c core.Conn) error {
+	return f.decodeInto(c, f.Payload[:0], false)
+}
+
+// DecodeInto decodes as Decode does, but reads the payload into
+// the backing array of dst, which f.Payload then aliases. A new
+// array is allocated only if cap(dst) is less than the payload size.
+func (f *Message) DecodeInto(c core.Conn, dst []byte) error {
+	return f.decodeInto(c, dst, false)
+}
+
+// DecodeUnmasked decodes as Decode does, but unmasks a masked
+// payload while copying it out of the read buffer, in one pass
+// rather than two, and clears f.MASK.
+func (f *Message) DecodeUnmasked(c core.Conn) error {
+	return f.decodeInto(c, f.Payload[:0], true)
+}
+
+func (f *Message) decodeInto(c core.Conn, dst []byte, unmask bool) (err error) {
+	for {
+		if err = f.decodeFrame(c, dst, unmask); err != errSkipped {
+			return
+		}
+	}
+}
+
+// errSkipped reports a frame discarded by its connection's header
+// check, such as one dropped by a rate limit
+var errSkipped = errors.New("frame skipped")
+
+// decodeFrame decodes the next frame as decodeInto does, but
+// returns errSkipped once a frame refused by c's header check has
+// been discarded, rather than reading on
+func (f *Message) decodeFrame(c core.Conn, dst []byte, unmask bool) (err error) {
 	if err = f.decodeHeader(c); err != nil {
 		return
 	}
 
-	f.Payload = make([]byte, f.PL)
+	if hc, ok := c.(headerChecker); ok {
+		var skip bool
+		if skip, err = hc.checkHeader(&f.FrameHeader); err != nil {
+			return
+		}
+		if skip {
+			if err = discard(c.Buf(), f.PL); err == nil {
+				err = errSkipped
+			}
+			return
+		}
+	}
+
+	if cap(dst) < f.PL {
+		dst = make([]byte, f.PL)
+	}
+
+	f.Payload = dst[:f.PL]
+	unmask = unmask && f.MASK
+
 	buf, read, n := c.Buf(), 0, 0
 
 	for buf.Available() < f.PL-read {
@@ -157,7 +346,7 @@ func (f *Message) Decode(c core.Conn) (err error) {
 			continue
 		}
 
-		n, err = buf.Read(f.Payload[read:])
+		n, err = f.readPayload(buf, read, unmask)
 		if err != nil && err != io.EOF {
 			return
 		}
@@ -165,16 +354,81 @@ func (f *Message) Decode(c core.Conn) (err error) {
 		read += n
 	}
 
-	if _, err = buf.Read(f.Payload[read:]); err == io.EOF {
+	if _, err = f.readPayload(buf, read, unmask); err == io.EOF {
 		err = nil
 	}
 
+	if unmask && err == nil {
+		f.MASK = false
+	}
+
 	return
 }
 
+// readPayload copies buffered bytes into f.Payload[from:], XOR-ing
+// them with the masking key if unmask is set
+func (f *Message) readPayload(buf core.Buf, from int, unmask bool) (n int, err error) {
+	dst := f.Payload[from:]
+	if !unmask {
+		return buf.Read(dst)
+	}
+
+	if r, ok := buf.(funcReader); ok {
+		f.um = unmasker{dst, f.MaskingKey, from}
+		n = r.ReadFunc(unmaskFunc, &f.um)
+		f.um.dst = nil
+		return
+	}
+
+	n, err = buf.Read(dst)
+	maskCopy(dst[:n], dst[:n], f.MaskingKey, from)
+	return
+}
+
+// discard consumes the next n bytes read into buf
+func discard(buf core.Buf, n int) (err error) {
+	var scratch [0x200]byte
+
+	for n > 0 {
+		if buf.Available() == 0 {
+			if err = buf.Fill(); err != nil && buf.Available() == 0 {
+				return
+			}
+		}
+
+		if r, ok := buf.(funcReader); ok {
+			r.ReadFunc(discardFunc, &n)
+			continue
+		}
+
+		m, _ := buf.Read(scratch[:min(n, buf.Available(), len(scratch))])
+		n -= m
+	}
+
+	return nil
+}
+
+func discardFunc(src []byte, arg any) int {
+	rem := arg.(*int)
+
+	n := min(len(src), *rem)
+	*rem -= n
+
+	return n
+}
+
+func unmaskFunc(src []byte, arg any) int {
+	u := arg.(*unmasker)
+
+	n := maskCopy(u.dst, src, u.key, u.pos)
+	u.dst, u.pos = u.dst[n:], u.pos+n
+
+	return n
+}
+
 func (f *Message) decodeHeader(c core.Conn) (err error) {
 	buf, read, target := c.Buf(), 0, 2
-	data := make([]byte, 2, 16)
+	data := f.hdr[:2]
 
 	for buf.Available() < target {
 		if err = buf.Fill(); err != nil {
@@ -189,8 +443,11 @@ func (f *Message) decodeHeader(c core.Conn) (err error) {
 
 	read += n
 
-	f.FIN = (data[0] & 0x80) == 1
-	f.Opcode = data[0] & 0x7
+	f.FIN = data[0]&0x80 != 0
+	f.RSV1 = data[0]&0x40 != 0
+	f.RSV2 = data[0]&0x20 != 0
+	f.RSV3 = data[0]&0x10 != 0
+	f.Opcode = data[0] & 0xf
 
 	f.PL = int(data[1] & 0x7f)
 
@@ -203,8 +460,7 @@ func (f *Message) decodeHeader(c core.Conn) (err error) {
 
 	var mstart int
 
-	if data[1]&0x80 != 0 {
-		f.MASK = true
+	if f.MASK = data[1]&0x80 != 0; f.MASK {
 		mstart = target
 		target += 4
 	}
@@ -217,8 +473,11 @@ func (f *Message) decodeHeader(c core.Conn) (err error) {
 
 	data = data[:target]
 
-	n, err = c.Buf().Read(data[read:])
-	if err != nil && err != io.EOF {
+	// a header without extended length or key leaves nothing to
+	// read, and Read reports io.EOF if that drained the buffer
+	if n, err = c.Buf().Read(data[read:]); err == io.EOF {
+		err = nil
+	} else if err != nil {
 		return
 	}
 
@@ -271,6 +530,41 @@ func (f *Message) ApplyMask() *Message {
 	return f
 }
 
+// maskCopy copies src into dst, XOR-ing with key as though src
+// began at offset pos of the payload, and returns the bytes copied.
+// Like UnsafeMask, it XORs 64 bits at a time directly on memory.
+func maskCopy(dst, src []byte, key [4]byte, pos int) int {
+	n := min(len(dst), len(src))
+
+	var k [8]byte
+	for i := range k {
+		k[i] = key[(pos+i)%4]
+	}
+	key64 := *(*uint64)(unsafe.Pointer(&k))
+
+	d := unsafe.Pointer(unsafe.SliceData(dst))
+	s := unsafe.Pointer(unsafe.SliceData(src))
+
+	var i int
+
+	for ; i+32 <= n; i += 32 {
+		*(*uint64)(unsafe.Add(d, i)) = *(*uint64)(unsafe.Add(s, i)) ^ key64
+		*(*uint64)(unsafe.Add(d, i+8)) = *(*uint64)(unsafe.Add(s, i+8)) ^ key64
+		*(*uint64)(unsafe.Add(d, i+16)) = *(*uint64)(unsafe.Add(s, i+16)) ^ key64
+		*(*uint64)(unsafe.Add(d, i+24)) = *(*uint64)(unsafe.Add(s, i+24)) ^ key64
+	}
+
+	for ; i+8 <= n; i += 8 {
+		*(*uint64)(unsafe.Add(d, i)) = *(*uint64)(unsafe.Add(s, i)) ^ key64
+	}
+
+	for ; i < n; i++ {
+		dst[i] = src[i] ^ key[(pos+i)%4]
+	}
+
+	return n
+}
+
 // UnsafeMask bypasses type-safety & `package binary` function calls to perform
 // 64-bit XOR directly on payload memory: >2x faster than ApplyMask
 func (f *Message) UnsafeMask() *Message {
@@ -296,6 +590,7 @@ func (f *Message) UnsafeMask() *Message {
 
 func NewCloseFrame(status uint16, reason string) *Message {
 	m := NewMessage(OpcodeClose)
+	m.FIN = true
 
 	if status != 0 {
 		var b strings.Builder
@@ -306,3 +601,13 @@ func NewCloseFrame(status uint16, reason string) *Message {
 
 	return m
 }
+
+// CloseStatus returns the status code carried by a close frame,
+// or 1005 (no status received) if the payload is empty
+func (f *Message) CloseStatus() uint16 {
+	if len(f.Payload) < 2 {
+		return StatusCodeNoStatus
+	}
+
+	return binary.BigEndian.Uint16(f.Payload[:2])
+}
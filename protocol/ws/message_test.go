@@ -3,12 +3,16 @@ package ws_test
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math"
+	"net"
 	"slices"
 	"strings"
 	"testing"
+	"unsafe"
 
+	"github.com/willmroliver/wsgo/core"
 	"github.com/willmroliver/wsgo/protocol/ws"
 	"github.com/willmroliver/wsgo/test"
 )
@@ -123,6 +127,46 @@ func TestEncode(t *testing.T) {
 	})
 }
 
+func TestEncodeClient(t *testing.T) {
+	w := new(bytes.Buffer)
+	c := ws.WrapClientConn(test.NewConn(strings.NewReader(""), w), "", "")
+
+	for _, n := range []int{0, 5, 0x1000 - 3, 0x2345} {
+		t.Run(fmt.Sprintf("%d bytes", n), func(t *testing.T) {
+			w.Reset()
+
+			payload := bytes.Repeat([]byte("abcdefg"), n/7+1)[:n]
+			f := ws.NewMessage(ws.OpcodeBinary).SetPayload(slices.Clone(payload))
+			f.FIN = true
+
+			if err := f.Encode(c); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !slices.Equal(payload, f.Payload) || f.MASK {
+				t.Errorf("exp caller's payload untouched\n")
+				return
+			}
+
+			g := new(ws.Message)
+			conn := ws.WrapConn(test.NewConn(bytes.NewReader(w.Bytes()), nil))
+			if err := g.Decode(conn); err != nil && err != io.EOF {
+				t.Error(err)
+				return
+			}
+
+			if !g.MASK || !g.FIN {
+				t.Errorf("exp FIN & MASK, got (%t, %t)\n", g.FIN, g.MASK)
+				return
+			}
+			if g.UnsafeMask(); !slices.Equal(payload, g.Payload) {
+				t.Errorf("exp unmasked payload to match\n")
+			}
+		})
+	}
+}
+
 func BenchmarkEncode(t *testing.B) {
 	r := strings.NewReader("")
 	w := new(bytes.Buffer)
@@ -134,12 +178,33 @@ func BenchmarkEncode(t *testing.B) {
 	f.NewMaskingKey()
 	f.ApplyMask()
 
+	t.ReportAllocs()
+
 	for t.Loop() {
 		f.Encode(conn)
 		w.Reset()
 	}
 }
 
+func BenchmarkEncodeLarge(t *testing.B) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go io.Copy(io.Discard, b)
+
+	conn := ws.WrapConn(a)
+	f := ws.NewMessage(ws.OpcodeBinary).
+		SetPayload(slices.Repeat([]byte{1, 2, 3, 4}, 0x4000))
+
+	t.ReportAllocs()
+	t.SetBytes(int64(len(f.Payload)))
+
+	for t.Loop() {
+		f.Encode(conn)
+	}
+}
+
 func TestDecode(t *testing.T) {
 	r := new(bytes.Reader)
 	w := new(bytes.Buffer)
@@ -230,10 +295,147 @@ func BenchmarkDecode(t *testing.B) {
 	w := new(bytes.Buffer)
 	conn := test.NewConn(r, w)
 
-	for t.Loop() {
-		conn.Buf().Reset(bytes.NewReader(data))
-		f.Decode(conn)
+	t.Run("Decode", func(t *testing.B) {
+		t.ReportAllocs()
+
+		for t.Loop() {
+			r.Reset(data)
+			conn.Buf().Reset(r)
+			f.Decode(conn)
+		}
+	})
+
+	t.Run("DecodeInto", func(t *testing.B) {
+		dst := make([]byte, len(data))
+		t.ReportAllocs()
+
+		for t.Loop() {
+			r.Reset(data)
+			conn.Buf().Reset(r)
+			f.DecodeInto(conn, dst)
+		}
+	})
+}
+
+func TestDecodeAllocs(t *testing.T) {
+	f := ws.NewMessage(ws.OpcodeBinary).
+		SetPayload(slices.Repeat([]byte{1, 2, 3, 4}, 0x100)).
+		NewMaskingKey().
+		ApplyMask()
+
+	data, _ := f.EncodeBytes()
+
+	r := bytes.NewReader(data)
+	conn := test.NewConn(r, new(bytes.Buffer))
+	dst := make([]byte, 0, len(data))
+
+	g := new(ws.Message)
+
+	for _, test := range []struct {
+		name   string
+		decode func()
+	}{
+		{"Decode", func() { g.Decode(conn) }},
+		{"DecodeInto", func() { g.DecodeInto(conn, dst) }},
+	} {
+		name, decode := test.name, test.decode
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(data)
+			conn.Buf().Reset(r)
+			decode()
+		})
+
+		if allocs != 0 {
+			t.Errorf("%s: exp 0 allocs, got %.1f\n", name, allocs)
+		}
+		if !slices.Equal(f.Payload, g.Payload) || g.MaskingKey != f.MaskingKey {
+			t.Errorf("%s: payload mismatch\n", name)
+		}
+	}
+
+	if unsafe.SliceData(g.Payload) != unsafe.SliceData(dst) {
+		t.Errorf("DecodeInto: exp payload to alias dst\n")
+	}
+}
+
+func TestDecodeUnmasked(t *testing.T) {
+	payload := make([]byte, 0x155)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	f := ws.NewMessage(ws.OpcodeBinary).
+		SetPayload(slices.Clone(payload)).
+		NewMaskingKey().
+		ApplyMask()
+
+	data, _ := f.EncodeBytes()
+	r := bytes.NewReader(data)
+	w := new(bytes.Buffer)
+
+	// a 0x40 byte ring wraps mid-payload at offsets which are not
+	// multiples of the key length
+	ring, _ := ws.NewConn(test.NewConn(r, w), ws.ServerConfig{ConnBufSize: 0x40})
+
+	for _, conn := range []core.Conn{ring, test.NewConn(r, w)} {
+		r.Reset(data)
+		conn.Buf().Reset(r)
+
+		g := new(ws.Message)
+		if err := g.DecodeUnmasked(conn); err != nil {
+			t.Errorf("%T: %v\n", conn, err)
+			return
+		}
+
+		if g.MASK || !slices.Equal(payload, g.Payload) {
+			t.Errorf("%T: exp unmasked payload, got MASK %t\n", conn, g.MASK)
+		}
 	}
+
+	g := new(ws.Message)
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(data)
+		ring.Buf().Reset(r)
+		g.DecodeUnmasked(ring)
+	})
+	if allocs != 0 {
+		t.Errorf("exp 0 allocs, got %.1f\n", allocs)
+	}
+}
+
+func BenchmarkDecodeMasked(t *testing.B) {
+	f := ws.NewMessage(ws.OpcodeBinary).
+		SetPayload(slices.Repeat([]byte{1, 2, 3, 4}, 0x200)).
+		NewMaskingKey().
+		ApplyMask()
+
+	data, _ := f.EncodeBytes()
+
+	r := bytes.NewReader(data)
+	conn := ws.WrapConn(test.NewConn(r, new(bytes.Buffer)))
+
+	t.Run("TwoPass", func(t *testing.B) {
+		t.SetBytes(int64(len(f.Payload)))
+		t.ReportAllocs()
+
+		for t.Loop() {
+			r.Reset(data)
+			conn.Buf().Reset(r)
+			f.Decode(conn)
+			f.UnsafeMask()
+		}
+	})
+
+	t.Run("Fused", func(t *testing.B) {
+		t.SetBytes(int64(len(f.Payload)))
+		t.ReportAllocs()
+
+		for t.Loop() {
+			r.Reset(data)
+			conn.Buf().Reset(r)
+			f.DecodeUnmasked(conn)
+		}
+	})
 }
 
 func maskTest(t *testing.T, do func(f *ws.Message)) {
@@ -0,0 +1,370 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/willmroliver/wsgo/core"
+)
+
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// errWouldBlock reports that a socket has nothing more to read yet
+var errWouldBlock = errors.New("read would block")
+
+// poller waits on every idle connection with a single epoll
+// instance. Registrations are one-shot, so a readable connection is
+// read by exactly one worker, which re-arms it once no whole frame
+// remains buffered. Sockets are read without blocking, so a frame
+// still arriving holds no worker: its bytes wait in the read buffer.
+type poller struct {
+	s     *Server
+	epfd  int
+	wake  [2]int
+	ready chan *Conn
+
+	mu     sync.Mutex
+	conns  map[int]*Conn
+	closed bool
+
+	// stop is closed, and stopped set, before ready is closed, so
+	// that connections delayed by a rate limit are not requeued
+	stop    chan struct{}
+	qmu     sync.RWMutex
+	stopped bool
+
+	wg sync.WaitGroup
+}
+
+func newPoller(s *Server, workers int) (p *poller, err error) {
+	p = &poller{
+		s:     s,
+		ready: make(chan *Conn, workers),
+		conns: make(map[int]*Conn),
+		stop:  make(chan struct{}),
+	}
+
+	if p.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	}
+
+	err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err == nil {
+		err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, p.wake[0],
+			&syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])})
+	}
+	if err != nil {
+		syscall.Close(p.epfd)
+		return nil, err
+	}
+
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+
+	go p.wait()
+	return
+}
+
+// add registers c, which is read at once if its handshake left
+// frames in the read buffer
+func (p *poller) add(c *Conn) (err error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	if c.raw, err = sc.SyscallConn(); err != nil {
+		return
+	}
+
+	if err = c.raw.Control(func(fd uintptr) { c.fd = int(fd) }); err != nil {
+		return
+	}
+
+	idle := c.buf.Available() == 0
+
+	p.mu.Lock()
+	p.conns[c.fd] = c
+	p.mu.Unlock()
+
+	ev := syscall.EpollEvent{Fd: int32(c.fd)}
+	if idle {
+		ev.Events = pollEvents
+	}
+
+	if err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, c.fd, &ev); err != nil {
+		p.remove(c)
+		return
+	}
+
+	if !idle {
+		p.ready <- c
+	}
+
+	return
+}
+
+func (p *poller) remove(c *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns[c.fd] == c {
+		delete(p.conns, c.fd)
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+}
+
+// arm waits for c to become readable again. Holding p.mu orders
+// the worker's use of c before that of the next worker to read it.
+func (p *poller) arm(c *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, c.fd,
+		&syscall.EpollEvent{Events: pollEvents, Fd: int32(c.fd)})
+}
+
+func (p *poller) wait() {
+	defer func() {
+		close(p.stop)
+
+		p.qmu.Lock()
+		p.stopped = true
+		p.qmu.Unlock()
+
+		close(p.ready)
+	}()
+
+	events := make([]syscall.EpollEvent, 0x80)
+
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == p.wake[0] {
+				return
+			}
+
+			p.mu.Lock()
+			c := p.conns[int(ev.Fd)]
+			p.mu.Unlock()
+
+			if c != nil {
+				p.ready <- c
+			}
+		}
+	}
+}
+
+func (p *poller) work() {
+	defer p.wg.Done()
+
+	m := new(Message)
+
+	for c := range p.ready {
+		p.read(c, m)
+	}
+}
+
+// read handles frames from c while whole frames are buffered,
+// reading the socket only as far as it has bytes ready
+func (p *poller) read(c *Conn, m *Message) {
+	for {
+		whole := frameBuffered(c.buf)
+
+		if !whole && !c.buf.Full() {
+			n, err := fill(c)
+			if err == errWouldBlock && n > 0 {
+				continue
+			}
+			if err == errWouldBlock {
+				p.arm(c)
+			} else if err != nil {
+				c.Close()
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// a frame larger than the read buffer is read on its own
+		// goroutine, as it may not yet have arrived in full
+		if !whole {
+			go p.readLarge(c)
+			return
+		}
+
+		// a frame delayed by the rate limit waits in the buffer,
+		// which holds the sender back as a sleeping reader would
+		if c.rate != nil {
+			var h FrameHeader
+			peekHeader(c.buf, &h)
+
+			if wait := c.rate.delay(&h); wait > 0 {
+				time.AfterFunc(wait, func() { p.requeue(c) })
+				return
+			}
+		}
+
+		switch err := m.decodeFrame(c, m.Payload[:0], true); err {
+		case nil:
+		case errSkipped:
+			continue
+		default:
+			c.Close()
+			return
+		}
+
+		if !p.s.handle(c, m) {
+			return
+		}
+	}
+}
+
+// requeue hands c back to the workers, unless the event loop has
+// stopped
+func (p *poller) requeue(c *Conn) {
+	p.qmu.RLock()
+	defer p.qmu.RUnlock()
+
+	if p.stopped {
+		return
+	}
+
+	select {
+	case p.ready <- c:
+	case <-p.stop:
+	}
+}
+
+// readLarge reads a frame which may block, then returns c to the
+// event loop
+func (p *poller) readLarge(c *Conn) {
+	m := new(Message)
+
+	if err := m.DecodeUnmasked(c); err != nil {
+		c.Close()
+		return
+	}
+	if p.s.handle(c, m) {
+		p.read(c, m)
+	}
+}
+
+// fill reads whatever c's socket has ready into its read buffer,
+// failing with errWouldBlock once nothing is
+func fill(c *Conn) (int64, error) {
+	return c.buf.(io.ReaderFrom).ReadFrom(rawReader{c.raw})
+}
+
+// rawReader reads a socket without waiting for it to be readable
+type rawReader struct {
+	rc syscall.RawConn
+}
+
+func (r rawReader) Read(p []byte) (n int, err error) {
+	var rerr error
+
+	err = r.rc.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), p)
+		return true
+	})
+
+	switch {
+	case err != nil:
+	case rerr == syscall.EAGAIN:
+		err = errWouldBlock
+	case rerr != nil:
+		err = rerr
+	case n == 0 && len(p) > 0:
+		err = io.EOF
+	}
+
+	if n < 0 {
+		n = 0
+	}
+	return
+}
+
+// frameBuffered reports whether buf holds a whole frame
+func frameBuffered(buf core.Buf) bool {
+	var h FrameHeader
+	size, ok := peekHeader(buf, &h)
+	return ok && h.PL >= 0 && buf.Available() >= size+h.PL
+}
+
+// peekHeader decodes the next frame header in buf into h without
+// consuming it, returning the header's length, or false if it has
+// not arrived in full
+func peekHeader(buf core.Buf, h *FrameHeader) (size int, ok bool) {
+	pk, ok := buf.(interface{ Peek([]byte) int })
+	if !ok {
+		return
+	}
+
+	var b [14]byte
+	n := pk.Peek(b[:])
+
+	if n < 2 {
+		return 0, false
+	}
+
+	h.FIN = b[0]&0x80 != 0
+	h.Opcode = b[0] & 0xf
+	h.MASK = b[1]&0x80 != 0
+
+	size, h.PL = 2, int(b[1]&0x7f)
+	switch h.PL {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h.MASK {
+		size += 4
+	}
+	if n < size {
+		return 0, false
+	}
+
+	switch h.PL {
+	case 126:
+		h.PL = int(binary.BigEndian.Uint16(b[2:4]))
+	case 127:
+		h.PL = int(binary.BigEndian.Uint64(b[2:10]))
+	}
+
+	return size, true
+}
+
+// close stops the event loop once in-flight reads complete.
+// Registered connections are left open.
+func (p *poller) close() {
+	syscall.Write(p.wake[1], []byte{0})
+	p.wg.Wait()
+
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	syscall.Close(p.epfd)
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+}
@@ -0,0 +1,139 @@
+package ws_test
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func TestPoll(t *testing.T) {
+	const conns = 500
+
+	url := echoServer(t, ws.PollConfig{Workers: 4})
+	base := runtime.NumGoroutine()
+
+	clients := make([]*ws.ClientConn, conns)
+	for i := range clients {
+		c, err := ws.Dial(url, ws.ClientConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Conn.Close()
+
+		clients[i] = c
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := echo(c, fmt.Appendf(nil, "client %d", i)); err != nil {
+				t.Errorf("client %d: %v\n", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// idle connections are parked on the event loop, not goroutines
+	if n := runtime.NumGoroutine() - base; n > conns/10 {
+		t.Errorf("exp idle connections to hold no goroutines, got %d\n", n)
+	}
+
+	// a large frame spans several reads of the same connection
+	if err := echo(clients[0], make([]byte, 0x10000)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPollPartialFrame(t *testing.T) {
+	url := echoServer(t, ws.PollConfig{Workers: 1})
+
+	slow, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Conn.Close()
+
+	// a masked binary frame of 5 bytes, stalled after its first 2
+	frame := []byte{0x82, 0x85, 0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	if _, err := slow.Conn.Write(frame[:8]); err != nil {
+		t.Fatal(err)
+	}
+
+	// which must not hold the only worker
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	c.Conn.SetDeadline(time.Now().Add(time.Second))
+	if err := echo(c, []byte("not blocked")); err != nil {
+		t.Fatal(err)
+	}
+
+	// and completes once the rest arrives
+	if _, err := slow.Conn.Write(frame[8:]); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(ws.Message)
+	if err := m.Decode(slow); err != nil || string(m.Payload) != "hello" {
+		t.Errorf("exp hello, got %q (%v)\n", m.Payload, err)
+	}
+}
+
+func TestPollRateDelay(t *testing.T) {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Poll = ws.PollConfig{Workers: 1}
+		s.Conf.Rate = ws.RateConfig{Messages: 4, MessageBurst: 1}
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			m.Encode(c)
+		})
+	})
+
+	slow, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Conn.Close()
+
+	// the second and third frames wait 250ms each
+	for i := range 3 {
+		if err := textFrame(fmt.Sprint(i), true).Encode(slow); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// without holding the only worker
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	start := time.Now()
+	if err := echo(c, []byte("not delayed")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("exp echo while another connection is delayed, took %v\n", d)
+	}
+
+	slow.Conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	m := new(ws.Message)
+	for i := range 3 {
+		if err := m.Decode(slow); err != nil || string(m.Payload) != fmt.Sprint(i) {
+			t.Fatalf("exp %d, got %q (%v)\n", i, m.Payload, err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package ws
+
+import "errors"
+
+type poller struct{}
+
+func newPoller(*Server, int) (*poller, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (p *poller) add(*Conn) error {
+	return errors.ErrUnsupported
+}
+
+func (p *poller) remove(*Conn) {}
+
+func (p *poller) close() {}
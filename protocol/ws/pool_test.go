@@ -0,0 +1,36 @@
+package ws_test
+
+import (
+	"testing"
+
+	"github.com/willmroliver/wsgo/core"
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func TestSharedBufs(t *testing.T) {
+	// the handler runs once the frame has been read, so reports on
+	// the buffer from the goroutine which owns it
+	allocated := make(chan bool, 1)
+
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Conf.SharedBufs = true
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			allocated <- c.Buf().(*core.RingBuf).Allocated()
+			ws.NewMessage(m.Opcode).SetPayload(m.Payload).Encode(c)
+		})
+	})
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	if err := echo(c, make([]byte, 0x2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if <-allocated {
+		t.Errorf("exp idle connection to hold no read buffer\n")
+	}
+}
@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/willmroliver/wsgo/core"
+)
+
+// PreparedMessage encodes a single-frame message once and caches
+// its wire form, so writing it to many connections costs little
+// more than the socket writes.
+//
+// The unmasked server frame is cached on first use. Client
+// connections must mask each frame with a fresh key, so they are
+// encoded on every write.
+type PreparedMessage struct {
+	Opcode  byte
+	Payload []byte
+
+	once  sync.Once
+	frame []byte
+}
+
+func NewPreparedMessage(op byte, payload []byte) *PreparedMessage {
+	return &PreparedMessage{
+		Opcode:  op,
+		Payload: payload,
+	}
+}
+
+// Encode writes the prepared frame to c
+func (p *PreparedMessage) Encode(c core.Conn) (err error) {
+	if isClient(c) {
+		return p.message().Encode(c)
+	}
+
+	p.once.Do(func() {
+		p.frame, _ = p.message().EncodeBytes()
+	})
+
+	l := lockFrame(c, p.Opcode)
+	defer unlockFrame(l, p.Opcode)
+
+	return writeFrame(c, p.Opcode, p.frame)
+}
+
+// Decode is unsupported: a PreparedMessage is write-only
+func (p *PreparedMessage) Decode(core.Conn) error {
+	return errors.ErrUnsupported
+}
+
+func (p *PreparedMessage) message() *Message {
+	m := NewMessage(p.Opcode).SetPayload(p.Payload)
+	m.FIN = true
+	return m
+}
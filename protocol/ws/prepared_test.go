@@ -0,0 +1,149 @@
+package ws_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+	"github.com/willmroliver/wsgo/test"
+)
+
+func TestPreparedMessage(t *testing.T) {
+	payload := slices.Repeat([]byte("update"), 0x1000)
+	p := ws.NewPreparedMessage(ws.OpcodeBinary, payload)
+
+	w := new(bytes.Buffer)
+	conn := test.NewConn(strings.NewReader(""), w)
+
+	m := ws.NewMessage(ws.OpcodeBinary).SetPayload(payload)
+	m.FIN = true
+	exp, _ := m.EncodeBytes()
+
+	if err := p.Encode(conn); err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(exp, w.Bytes()) {
+		t.Errorf("exp prepared frame to match Message.EncodeBytes\n")
+		return
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		w.Reset()
+		p.Encode(conn)
+	})
+	if allocs != 0 {
+		t.Errorf("exp 0 allocs, got %.1f\n", allocs)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ws.NewServerListener(l)
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+
+	defer cancel()
+
+	clients := make([]*ws.ClientConn, 3)
+	for i := range clients {
+		if clients[i], err = ws.Dial("ws://"+l.Addr().String()+"/", ws.ClientConfig{}); err != nil {
+			t.Error(err)
+			return
+		}
+		defer clients[i].Conn.Close()
+	}
+
+	time.Sleep(time.Millisecond)
+
+	p := ws.NewPreparedMessage(ws.OpcodeText, []byte("hello all"))
+	if err := s.Broadcast(p); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, c := range clients {
+		m := new(ws.Message)
+		if err := m.Decode(c); err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := "hello all"; string(m.Payload) != exp || !m.FIN {
+			t.Errorf("client %d: exp %q, got %q\n", i, exp, m.Payload)
+		}
+	}
+}
+
+func TestBroadcastSlowClient(t *testing.T) {
+	s, url := runServer(t, func(*ws.Server) {})
+
+	// a client which never reads stalls the broadcast
+	slow, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		p := ws.NewPreparedMessage(ws.OpcodeBinary, make([]byte, 64<<20))
+		done <- s.Broadcast(p)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// which must not block connections arriving meanwhile
+	c, err := ws.Dial(url, ws.ClientConfig{
+		NetDial: func(network, address string) (net.Conn, error) {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				conn.SetDeadline(time.Now().Add(time.Second))
+			}
+			return conn, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Conn.Close()
+
+	slow.Conn.Close()
+	<-done
+}
+
+func BenchmarkPreparedMessage(t *testing.B) {
+	payload := slices.Repeat([]byte{1, 2, 3, 4}, 0x1400)
+	w := new(bytes.Buffer)
+	conn := test.NewConn(strings.NewReader(""), w)
+
+	t.Run("Message", func(t *testing.B) {
+		t.ReportAllocs()
+
+		for t.Loop() {
+			m := ws.NewMessage(ws.OpcodeBinary).SetPayload(payload)
+			m.FIN = true
+			m.Encode(conn)
+			w.Reset()
+		}
+	})
+
+	t.Run("PreparedMessage", func(t *testing.B) {
+		p := ws.NewPreparedMessage(ws.OpcodeBinary, payload)
+		t.ReportAllocs()
+
+		for t.Loop() {
+			p.Encode(conn)
+			w.Reset()
+		}
+	})
+}
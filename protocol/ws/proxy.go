@@ -0,0 +1,271 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/willmroliver/wsgo/core"
+	"github.com/willmroliver/wsgo/protocol/http1"
+)
+
+var (
+	ErrUntrustedProxy = errors.New("PROXY header from untrusted peer")
+	ErrProxyHeader    = errors.New("invalid PROXY header")
+)
+
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107
+	proxyV2Sig    = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+// ProxyConfig recovers client addresses from peers in Trusted, such
+// as load balancers, which then become the address reported by
+// Conn.RemoteAddr.
+//
+// Protocol accepts a HAProxy PROXY protocol v1 or v2 header ahead of
+// the upgrade request, rejecting connections from other peers which
+// send one. Headers trusts the nearest address in X-Forwarded-For or
+// Forwarded which is not itself in Trusted.
+type ProxyConfig struct {
+	Protocol bool
+	Headers  bool
+	Trusted  []netip.Prefix
+}
+
+// trusts reports whether addr is in one of conf.Trusted
+func (conf *ProxyConfig) trusts(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	return ok && conf.trustsIP(ip)
+}
+
+func (conf *ProxyConfig) trustsIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range conf.Trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr(), true
+	case nil:
+		return netip.Addr{}, false
+	}
+
+	ap, err := netip.ParseAddrPort(addr.String())
+	return ap.Addr(), err == nil
+}
+
+// readProxyHeader consumes a PROXY header from b, if peer sent one,
+// returning the source address it carries or nil for a v2 LOCAL
+// command or a v1 UNKNOWN protocol
+func readProxyHeader(b core.Buf, peer net.Addr, conf *ProxyConfig) (net.Addr, error) {
+	// every request line outlasts the longer v2 signature, so
+	// waiting for it never blocks a plain upgrade request
+	if err := fillAtLeast(b, len(proxyV2Sig)); err != nil {
+		return nil, err
+	}
+
+	v1 := b.IndexOf([]byte(proxyV1Prefix)) == 0
+	v2 := b.IndexOf([]byte(proxyV2Sig)) == 0
+
+	if !v1 && !v2 {
+		return nil, nil
+	}
+	if !conf.trusts(peer) {
+		return nil, ErrUntrustedProxy
+	}
+
+	if v1 {
+		return readProxyV1(b)
+	}
+	return readProxyV2(b)
+}
+
+// fillAtLeast reads into b until it holds n bytes
+func fillAtLeast(b core.Buf, n int) error {
+	for b.Available() < n {
+		if b.Full() {
+			return core.ErrBadHeader
+		}
+		if err := b.Fill(); err != nil && b.Available() < n {
+			return err
+		}
+	}
+	return nil
+}
+
+func readProxyV1(b core.Buf) (net.Addr, error) {
+	i := b.IndexOf([]byte(http1.CRLF))
+	for i == -1 {
+		if b.Available() >= proxyV1MaxLen {
+			return nil, ErrProxyHeader
+		}
+		if err := fillAtLeast(b, b.Available()+1); err != nil {
+			return nil, err
+		}
+		i = b.IndexOf([]byte(http1.CRLF))
+	}
+	if i+len(http1.CRLF) > proxyV1MaxLen {
+		return nil, ErrProxyHeader
+	}
+
+	line := make([]byte, i+len(http1.CRLF))
+	if _, err := b.Read(line); err != nil {
+		return nil, err
+	}
+
+	// PROXY TCP4|TCP6 src dst sport dport, or PROXY UNKNOWN ...
+	f := strings.Fields(string(line[:i]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil || ip.Is4() != (f[1] == "TCP4") {
+		return nil, ErrProxyHeader
+	}
+
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2(b core.Buf) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := b.Read(hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[14:]))
+	if err := fillAtLeast(b, n); err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, n)
+	if _, err := b.Read(body); err != nil {
+		return nil, err
+	}
+
+	// a LOCAL command, e.g. a health check, describes no client
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	if hdr[12]&0xf != 1 {
+		return nil, ErrProxyHeader
+	}
+
+	var ip netip.Addr
+	var port []byte
+
+	switch hdr[13] >> 4 {
+	case 1:
+		if n < 12 {
+			return nil, ErrProxyHeader
+		}
+		ip = netip.AddrFrom4([4]byte(body[:4]))
+		port = body[8:10]
+	case 2:
+		if n < 36 {
+			return nil, ErrProxyHeader
+		}
+		ip = netip.AddrFrom16([16]byte(body[:16]))
+		port = body[32:34]
+	default:
+		// AF_UNSPEC or AF_UNIX carry no usable address
+		return nil, nil
+	}
+
+	ap := netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))
+	return net.TCPAddrFromAddrPort(ap), nil
+}
+
+// forwardedAddr returns the client address from the Forwarded or,
+// failing that, X-Forwarded-For headers of a request sent by peer:
+// the rightmost address which is not in conf.Trusted, or nil if
+// peer is untrusted or the headers are absent or unusable
+func forwardedAddr(
+	conf *ProxyConfig,
+	peer net.Addr,
+	values func(string) []string,
+) net.Addr {
+	if !conf.trusts(peer) {
+		return nil
+	}
+
+	hops := forwardedFor(values("Forwarded"))
+	if hops == nil {
+		for _, v := range values("X-Forwarded-For") {
+			for h := range strings.SplitSeq(v, ",") {
+				hops = append(hops, strings.TrimSpace(h))
+			}
+		}
+	}
+
+	var addr netip.AddrPort
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ap, ok := parseHop(hops[i])
+		if !ok {
+			// obfuscated or unknown hops can't be attributed
+			return nil
+		}
+
+		addr = ap
+		if !conf.trustsIP(ap.Addr()) {
+			break
+		}
+	}
+
+	if !addr.IsValid() {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addr)
+}
+
+// forwardedFor returns the for= parameter of each element of the
+// Forwarded header values, in order
+func forwardedFor(values []string) (hops []string) {
+	for _, v := range values {
+		for elem := range strings.SplitSeq(v, ",") {
+			for pair := range strings.SplitSeq(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return
+}
+
+// parseHop parses an IP address with an optional port, where IPv6
+// addresses with a port are bracketed
+func parseHop(s string) (netip.AddrPort, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap, true
+	}
+
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip, err := netip.ParseAddr(s)
+	return netip.AddrPortFrom(ip, 0), err == nil
+}
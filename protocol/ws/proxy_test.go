@@ -0,0 +1,167 @@
+package ws_test
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// addrServer runs a Server which replies to each data frame with
+// the connection's RemoteAddr
+func addrServer(t *testing.T, proxy ws.ProxyConfig) string {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Conf.Proxy = proxy
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			reply := ws.NewMessage(ws.OpcodeText).
+				SetPayload([]byte(c.RemoteAddr().String()))
+			reply.FIN = true
+			reply.Encode(c)
+		})
+	})
+
+	return url
+}
+
+// remoteAddr dials url, sending prefix ahead of the handshake, and
+// returns the address the server reports for the connection
+func remoteAddr(url string, prefix []byte, headers map[string]string) (string, error) {
+	c, err := ws.Dial(url, ws.ClientConfig{
+		Headers: headers,
+		NetDial: func(network, address string) (net.Conn, error) {
+			conn, err := net.Dial(network, address)
+			if err == nil && len(prefix) > 0 {
+				_, err = conn.Write(prefix)
+			}
+			return conn, err
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer c.Conn.Close()
+
+	m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("?"))
+	m.FIN = true
+	if err = m.Encode(c); err != nil {
+		return "", err
+	}
+	if err = m.Decode(c); err != nil {
+		return "", err
+	}
+
+	return string(m.Payload), nil
+}
+
+func proxyV2(src netip.AddrPort) []byte {
+	p := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24")
+	p = append(p, src.Addr().AsSlice()...)
+	p = append(p, netip.IPv6Loopback().AsSlice()...)
+	p = binary.BigEndian.AppendUint16(p, src.Port())
+	return binary.BigEndian.AppendUint16(p, 443)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	url := addrServer(t, ws.ProxyConfig{
+		Protocol: true,
+		Trusted:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+
+	tests := []struct {
+		name   string
+		prefix []byte
+		exp    string
+	}{
+		{"v1", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 443\r\n"), "203.0.113.7:5555"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2", proxyV2(netip.MustParseAddrPort("[2001:db8::7]:6000")), "[2001:db8::7]:6000"},
+		{"none", nil, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := remoteAddr(url, tt.prefix, nil)
+		if err != nil {
+			t.Errorf("%s: %v\n", tt.name, err)
+			continue
+		}
+
+		// without a source address, the peer's own is kept
+		if tt.exp == "" {
+			if ap, err := netip.ParseAddrPort(got); err != nil || !ap.Addr().IsLoopback() {
+				t.Errorf("%s: exp loopback peer address, got %s\n", tt.name, got)
+			}
+		} else if got != tt.exp {
+			t.Errorf("%s: exp %s, got %s\n", tt.name, tt.exp, got)
+		}
+	}
+
+	if _, err := remoteAddr(url, []byte("PROXY TCP4 nonsense\r\n"), nil); err == nil {
+		t.Errorf("exp malformed PROXY header to be rejected\n")
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	url := addrServer(t, ws.ProxyConfig{
+		Protocol: true,
+		Trusted:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+
+	if _, err := remoteAddr(url, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 443\r\n"), nil); err == nil {
+		t.Errorf("exp PROXY header from untrusted peer to be rejected\n")
+	}
+	if _, err := remoteAddr(url, nil, nil); err != nil {
+		t.Errorf("exp plain connection from untrusted peer, got %v\n", err)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	trusted := ws.ProxyConfig{
+		Headers: true,
+		Trusted: []netip.Prefix{
+			netip.MustParsePrefix("127.0.0.0/8"),
+			netip.MustParsePrefix("10.0.0.0/8"),
+		},
+	}
+
+	url := addrServer(t, trusted)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		exp     string
+	}{
+		{"xff", map[string]string{"X-Forwarded-For": "198.51.100.9"}, "198.51.100.9:0"},
+		{"xff chain", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.9, 10.1.2.3"}, "198.51.100.9:0"},
+		{"forwarded", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}, "[2001:db8::1]:4711"},
+		{"obfuscated", map[string]string{"Forwarded": "for=_hidden"}, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := remoteAddr(url, nil, tt.headers)
+		if err != nil {
+			t.Errorf("%s: %v\n", tt.name, err)
+			continue
+		}
+
+		if tt.exp == "" {
+			if ap, err := netip.ParseAddrPort(got); err != nil || !ap.Addr().IsLoopback() {
+				t.Errorf("%s: exp loopback peer address, got %s\n", tt.name, got)
+			}
+		} else if got != tt.exp {
+			t.Errorf("%s: exp %s, got %s\n", tt.name, tt.exp, got)
+		}
+	}
+
+	// headers from untrusted peers are ignored
+	url = addrServer(t, ws.ProxyConfig{
+		Headers: true,
+		Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+
+	got, err := remoteAddr(url, nil, map[string]string{"X-Forwarded-For": "198.51.100.9"})
+	if err != nil || got == "198.51.100.9:0" {
+		t.Errorf("exp X-Forwarded-For from untrusted peer ignored, got %s (%v)\n", got, err)
+	}
+}
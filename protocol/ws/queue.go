@@ -0,0 +1,292 @@
+package ws
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type QueuePolicy int
+
+const (
+	// QueueBlock makes writers wait for space in the queue
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the longest-queued unfragmented message
+	QueueDropOldest
+	// QueueDropNewest discards the message being written
+	QueueDropNewest
+	// QueueClose sends a 1008 close and closes the connection
+	QueueClose
+)
+
+// queueFlushTimeout bounds how long Close waits for a slow reader
+// to accept frames still in the queue
+const queueFlushTimeout = time.Second
+
+var ErrQueueClosed = errors.New("write queue closed")
+
+// QueueConfig enables a per-connection write goroutine when Size,
+// the maximum number of frames waiting to be written, is positive.
+//
+// Queued frames are flushed together with a single vectored write,
+// and Policy decides what happens to writes made while it is full.
+type QueueConfig struct {
+	Size   int
+	Policy QueuePolicy
+}
+
+// writeQueue owns all writes to conn once started, so each queued
+// element must be a complete frame. The first controls frames are
+// control frames, which jump ahead of queued data.
+type writeQueue struct {
+	conn net.Conn
+	conf QueueConfig
+
+	// onClose closes the owning connection once the close frame
+	// queued by the QueueClose policy has been written
+	onClose func()
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	frames   [][]byte
+	controls int
+	closing  bool
+	overflow bool
+	dropping bool
+	err      error
+	done     chan struct{}
+
+	dropped atomic.Uint64
+}
+
+func newWriteQueue(conn net.Conn, conf QueueConfig, onClose func()) *writeQueue {
+	q := &writeQueue{
+		conn:    conn,
+		conf:    conf,
+		onClose: onClose,
+		frames:  make([][]byte, 0, conf.Size),
+		done:    make(chan struct{}),
+	}
+
+	q.cond.L = &q.mu
+
+	go q.run()
+	return q
+}
+
+// push queues a copy of each of bufs as a single frame. Control
+// frames are not subject to Size or Policy: pings and pongs jump
+// ahead of queued data, while a close waits behind it. Fragments are never dropped alone: a message's first frame
+// decides whether the rest of it is queued.
+func (q *writeQueue) push(bufs ...[]byte) (n int, err error) {
+	var frame []byte
+	for _, b := range bufs {
+		frame = append(frame, b...)
+	}
+
+	op, fin := frameOp(frame)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !isControl(op) {
+		if op == OpcodeCont && q.dropping {
+			q.dropping = !fin
+			return len(frame), nil
+		}
+
+		drop, err := q.reserve(op, fin)
+		if err != nil {
+			return 0, err
+		}
+		if drop {
+			return len(frame), nil
+		}
+	}
+
+	if q.err != nil {
+		return 0, q.err
+	}
+	if q.closing {
+		return 0, ErrQueueClosed
+	}
+
+	if isControl(op) && op != OpcodeClose {
+		q.frames = slices.Insert(q.frames, q.controls, frame)
+		q.controls++
+	} else {
+		q.frames = append(q.frames, frame)
+	}
+
+	q.cond.Broadcast()
+
+	return len(frame), nil
+}
+
+// reserve applies Policy to a data frame while the queue is full,
+// reporting whether the frame, and the rest of its message, is
+// dropped. q.mu must be held.
+func (q *writeQueue) reserve(op byte, fin bool) (drop bool, err error) {
+	for q.err == nil && !q.closing && len(q.frames) >= q.conf.Size {
+		switch q.conf.Policy {
+		case QueueBlock:
+			q.cond.Wait()
+			continue
+		case QueueDropOldest:
+			i := q.oldestMessage()
+			if i < 0 {
+				q.cond.Wait()
+				continue
+			}
+			q.frames = slices.Delete(q.frames, i, i+1)
+		case QueueDropNewest:
+			// the rest of a queued message must follow it
+			if op == OpcodeCont {
+				q.cond.Wait()
+				continue
+			}
+			q.dropped.Add(1)
+			q.dropping = !fin
+			return true, nil
+		case QueueClose:
+			q.frames, q.controls = q.frames[:0], 0
+			q.overflow = !q.closing
+			q.closeWith(NewCloseFrame(StatusCodePolicyViolated, "write queue full"))
+			return false, ErrQueueClosed
+		}
+
+		q.dropped.Add(1)
+	}
+
+	return false, nil
+}
+
+// oldestMessage returns the index of the oldest queued data frame
+// which is a whole message, or -1 if there is none
+func (q *writeQueue) oldestMessage() int {
+	for i := q.controls; i < len(q.frames); i++ {
+		if op, fin := frameOp(q.frames[i]); fin && op != OpcodeCont && !isControl(op) {
+			return i
+		}
+	}
+	return -1
+}
+
+// frameOp returns the opcode and FIN bit of a serialized frame
+func frameOp(frame []byte) (op byte, fin bool) {
+	if len(frame) == 0 {
+		return OpcodeBinary, true
+	}
+	return frame[0] & 0xf, frame[0]&0x80 != 0
+}
+
+// closeWith queues m as the final frame, after which the
+// connection is closed. q.mu must be held.
+func (q *writeQueue) closeWith(m *Message) {
+	if q.closing {
+		return
+	}
+
+	if m != nil {
+		frame, _ := m.EncodeBytes()
+		q.frames = append(q.frames, frame)
+	}
+
+	q.closing = true
+	q.cond.Broadcast()
+}
+
+// close flushes any queued frames and stops the write goroutine
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	q.closeWith(nil)
+	q.mu.Unlock()
+
+	q.conn.SetWriteDeadline(time.Now().Add(queueFlushTimeout))
+	<-q.done
+}
+
+func (q *writeQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.frames)
+}
+
+func (q *writeQueue) run() {
+	defer close(q.done)
+
+	var (
+		bufs    net.Buffers
+		scratch []byte
+	)
+
+	for {
+		q.mu.Lock()
+		for len(q.frames) == 0 && !q.closing {
+			q.cond.Wait()
+		}
+
+		closing := q.closing
+		bufs, scratch = coalesce(bufs[:0], scratch[:0], q.frames)
+		clear(q.frames)
+		q.frames, q.controls = q.frames[:0], 0
+
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		// WriteTo consumes its receiver, so keep bufs for reuse
+		wb := bufs
+		if _, err := wb.WriteTo(q.conn); err != nil {
+			q.mu.Lock()
+			q.err = err
+			q.frames, q.controls = q.frames[:0], 0
+			q.cond.Broadcast()
+			q.mu.Unlock()
+
+			return
+		}
+
+		if closing {
+			q.mu.Lock()
+			n, overflow := len(q.frames), q.overflow
+			q.mu.Unlock()
+
+			if n == 0 {
+				// onClose waits for run to return
+				if overflow {
+					go q.onClose()
+				}
+				return
+			}
+		}
+	}
+}
+
+// coalesce appends frames to bufs, copying runs of small frames
+// into scratch so that each run is written as one contiguous slice
+func coalesce(bufs net.Buffers, scratch []byte, frames [][]byte) (net.Buffers, []byte) {
+	start := 0
+
+	for _, f := range frames {
+		if len(f) < writeBufSize {
+			scratch = append(scratch, f...)
+			continue
+		}
+
+		if start < len(scratch) {
+			bufs = append(bufs, scratch[start:])
+			start = len(scratch)
+		}
+		bufs = append(bufs, f)
+	}
+
+	if start < len(scratch) {
+		bufs = append(bufs, scratch[start:])
+	}
+
+	return bufs, scratch
+}
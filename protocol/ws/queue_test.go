@@ -0,0 +1,349 @@
+package ws_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/core"
+	"github.com/willmroliver/wsgo/protocol/ws"
+	"github.com/willmroliver/wsgo/test"
+)
+
+// gatedConn holds its first Write until release is closed,
+// simulating a peer which has stopped reading
+type gatedConn struct {
+	net.Conn
+
+	entered, release chan struct{}
+
+	mu     sync.Mutex
+	writes [][]byte
+	closed bool
+}
+
+func newGatedConn() *gatedConn {
+	return &gatedConn{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (c *gatedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	first := len(c.writes) == 0
+	c.writes = append(c.writes, bytes.Clone(p))
+	c.mu.Unlock()
+
+	if first {
+		close(c.entered)
+		<-c.release
+	}
+
+	return len(p), nil
+}
+
+func (c *gatedConn) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (c *gatedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *gatedConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *gatedConn) Writes() ([][]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes, c.closed
+}
+
+func queuedConn(policy ws.QueuePolicy) (*ws.Conn, *gatedConn) {
+	g := newGatedConn()
+
+	c, _ := ws.NewConn(g, ws.ServerConfig{
+		Queue: ws.QueueConfig{Size: 2, Policy: policy},
+	})
+	return c, g
+}
+
+func frame(b byte) *ws.Message {
+	m := ws.NewMessage(ws.OpcodeBinary).SetPayload([]byte{b})
+	m.FIN = true
+	return m
+}
+
+func TestQueuePolicies(t *testing.T) {
+	type Test struct {
+		policy  ws.QueuePolicy
+		exp     []byte
+		dropped uint64
+	}
+
+	tests := map[string]*Test{
+		"Drop oldest": {ws.QueueDropOldest, []byte{1, 3, 4}, 1},
+		"Drop newest": {ws.QueueDropNewest, []byte{1, 2, 3}, 1},
+		"Block":       {ws.QueueBlock, []byte{1, 2, 3, 4}, 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, g := queuedConn(test.policy)
+
+			frame(1).Encode(c)
+			<-g.entered
+
+			frame(2).Encode(c)
+			frame(3).Encode(c)
+
+			if exp, got := 2, c.QueueDepth(); exp != got {
+				t.Errorf("depth: exp %d, got %d\n", exp, got)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				frame(4).Encode(c)
+				close(done)
+			}()
+
+			if test.policy == ws.QueueBlock {
+				select {
+				case <-done:
+					t.Errorf("exp Encode to block on a full queue\n")
+				case <-time.After(10 * time.Millisecond):
+				}
+			} else {
+				<-done
+			}
+
+			close(g.release)
+			<-done
+			c.Close()
+
+			var got []byte
+			writes, _ := g.Writes()
+			for _, w := range writes {
+				for i := 0; i < len(w); i += 3 {
+					got = append(got, w[i+2])
+				}
+			}
+
+			if !bytes.Equal(test.exp, got) {
+				t.Errorf("exp payloads %v, got %v\n", test.exp, got)
+			}
+			if exp, got := test.dropped, c.QueueDropped(); exp != got {
+				t.Errorf("dropped: exp %d, got %d\n", exp, got)
+			}
+		})
+	}
+}
+
+func TestQueueFragments(t *testing.T) {
+	type Test struct {
+		policy  ws.QueuePolicy
+		queued  []byte
+		exp     string
+		dropped uint64
+	}
+
+	// a fragmented message is dropped whole, or written whole
+	tests := map[string]*Test{
+		"Drop oldest":           {ws.QueueDropOldest, []byte{2, 3}, "\x01abc", 2},
+		"Drop newest":           {ws.QueueDropNewest, []byte{2, 3}, "\x01\x02\x03", 1},
+		"Drop newest with room": {ws.QueueDropNewest, []byte{2}, "\x01\x02abc", 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, g := queuedConn(test.policy)
+
+			frame(1).Encode(c)
+			<-g.entered
+
+			for _, b := range test.queued {
+				frame(b).Encode(c)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				ws.NewMessage(ws.OpcodeText).SetPayload([]byte("abc")).EncodeFragments(c, 1)
+				close(done)
+			}()
+
+			// release the peer once the full queue has been met
+			for deadline := time.Now().Add(time.Second); c.QueueDropped() < test.dropped; {
+				if time.Now().After(deadline) {
+					t.Fatalf("exp %d frames dropped\n", test.dropped)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			close(g.release)
+			<-done
+			c.Close()
+
+			var got []byte
+			var conts int
+			writes, _ := g.Writes()
+			for _, w := range writes {
+				for i := 0; i < len(w); i += 3 {
+					if w[i]&0xf == ws.OpcodeCont {
+						conts++
+					}
+					got = append(got, w[i+2])
+				}
+			}
+
+			if test.exp != string(got) {
+				t.Errorf("exp payloads %q, got %q\n", test.exp, got)
+			}
+			if exp := strings.Count(test.exp, "b") * 2; exp != conts {
+				t.Errorf("exp %d continuation frames, got %d\n", exp, conts)
+			}
+			if exp, got := test.dropped, c.QueueDropped(); exp != got {
+				t.Errorf("dropped: exp %d, got %d\n", exp, got)
+			}
+		})
+	}
+}
+
+// closeServer records the connections closed through it
+type closeServer struct {
+	closed chan core.Conn
+}
+
+func (s *closeServer) Run(context.Context) error {
+	return nil
+}
+
+func (s *closeServer) Accept() (core.Conn, error) {
+	return nil, net.ErrClosed
+}
+
+func (s *closeServer) Close(c core.Conn) error {
+	s.closed <- c
+	return nil
+}
+
+func TestQueueClosePolicy(t *testing.T) {
+	c, g := queuedConn(ws.QueueClose)
+
+	s := &closeServer{make(chan core.Conn, 1)}
+	c.Server = s
+
+	frame(1).Encode(c)
+	<-g.entered
+
+	frame(2).Encode(c)
+	frame(3).Encode(c)
+
+	if err := frame(4).Encode(c); err != ws.ErrQueueClosed {
+		t.Errorf("exp %v, got %v\n", ws.ErrQueueClosed, err)
+	}
+
+	close(g.release)
+
+	// the connection closes itself, through its server
+	select {
+	case got := <-s.closed:
+		if got != c {
+			t.Errorf("exp the queue's connection closed\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("exp connection closed once the close frame was sent\n")
+	}
+
+	writes, closed := g.Writes()
+	if !closed || len(writes) != 2 {
+		t.Errorf("exp 2 writes then close, got (%d, %t)\n", len(writes), closed)
+		return
+	}
+
+	m := new(ws.Message)
+	if err := m.Decode(ws.WrapConn(test.NewConn(bytes.NewReader(writes[1]), nil))); err != nil {
+		t.Error(err)
+		return
+	}
+	if exp := uint16(ws.StatusCodePolicyViolated); m.Opcode != ws.OpcodeClose || m.CloseStatus() != exp {
+		t.Errorf("exp close %d, got (%d, %d)\n", exp, m.Opcode, m.CloseStatus())
+	}
+}
+
+func TestQueueCloseFrame(t *testing.T) {
+	// a close is never dropped, nor its status replaced, when full
+	for name, policy := range map[string]ws.QueuePolicy{
+		"Drop newest": ws.QueueDropNewest,
+		"Close":       ws.QueueClose,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, g := queuedConn(policy)
+
+			frame(1).Encode(c)
+			<-g.entered
+
+			frame(2).Encode(c)
+			frame(3).Encode(c)
+
+			if err := ws.NewCloseFrame(ws.StatusCodeTryAgainLater, "").Encode(c); err != nil {
+				t.Errorf("exp close queued, got %v\n", err)
+			}
+
+			close(g.release)
+			c.Close()
+
+			writes, _ := g.Writes()
+			wire := bytes.Join(writes, nil)
+
+			r := ws.WrapConn(test.NewConn(bytes.NewReader(wire), nil))
+			m := new(ws.Message)
+
+			var got []byte
+			for m.Decode(r) == nil && m.Opcode == ws.OpcodeBinary {
+				got = append(got, m.Payload...)
+			}
+
+			if exp := []byte{1, 2, 3}; !bytes.Equal(exp, got) {
+				t.Errorf("exp payloads %v, got %v\n", exp, got)
+			}
+			if exp := uint16(ws.StatusCodeTryAgainLater); m.Opcode != ws.OpcodeClose || m.CloseStatus() != exp {
+				t.Errorf("exp close %d after data, got (%d, %d)\n", exp, m.Opcode, m.CloseStatus())
+			}
+		})
+	}
+}
+
+func TestQueueCoalesce(t *testing.T) {
+	g := newGatedConn()
+	c, _ := ws.NewConn(g, ws.ServerConfig{
+		Queue: ws.QueueConfig{Size: 16},
+	})
+
+	frame(0).Encode(c)
+	<-g.entered
+
+	for i := range 10 {
+		frame(byte(i + 1)).Encode(c)
+	}
+
+	close(g.release)
+	c.Close()
+
+	writes, _ := g.Writes()
+	if exp, got := 2, len(writes); exp != got {
+		t.Errorf("exp %d writes, got %d\n", exp, got)
+		return
+	}
+	if exp, got := 30, len(writes[1]); exp != got {
+		t.Errorf("exp %d coalesced bytes, got %d\n", exp, got)
+	}
+}
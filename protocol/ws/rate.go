@@ -0,0 +1,200 @@
+package ws
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrRateLimited = errors.New("message rate limit exceeded")
+
+// RateAction selects what happens to frames over a RateConfig limit
+type RateAction int
+
+const (
+	// RateDelay stops reading until the limit allows the frame, so
+	// that TCP flow control slows the sender
+	RateDelay RateAction = iota
+	// RateDrop discards the frame unread, along with the rest of its
+	// message if it is fragmented
+	RateDrop
+	// RateClose closes the connection with 1008 (policy violation)
+	RateClose
+)
+
+// RateConfig limits incoming frames with token buckets, refilled at
+// Messages per second and Bytes of payload per second, holding up
+// to MessageBurst and ByteBurst (default one second's worth), where
+// each rate is positive.
+//
+// Each message, or control frame other than a close, counts once.
+// Limits are checked on a message's first frame before its payload
+// is read, and its continuation frames follow the same decision.
+// A frame larger than ByteBurst is allowed once the bucket is full.
+// On the event loop enabled by Server.Poll, a delayed connection
+// returns its worker and is read again once the delay has passed.
+//
+// Clock, if set, replaces the system clock. Only its Now is used on
+// the event loop.
+type RateConfig struct {
+	Messages     float64
+	MessageBurst int
+	Bytes        float64
+	ByteBurst    int
+	Action       RateAction
+	Clock        Clock
+}
+
+// Clock supplies the time to rate limits, so that tests may
+// substitute a fake
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// bucket holds tokens refilled at rate per second, up to burst. A
+// cost may overdraw it, and later frames wait until it recovers.
+type bucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+}
+
+func newBucket(rate float64, burst int, now time.Time) bucket {
+	b := bucket{rate: rate, burst: float64(burst), last: now}
+	if b.burst <= 0 {
+		b.burst = max(rate, 1)
+	}
+
+	b.tokens = b.burst
+	return b
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until cost may be taken
+func (b *bucket) wait(cost float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	need := min(cost, b.burst) - b.tokens
+	if need <= 0 {
+		return 0
+	}
+
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(cost float64) {
+	if b.rate > 0 {
+		b.tokens -= cost
+	}
+}
+
+// rateLimit applies a RateConfig to the frames read from one
+// connection
+type rateLimit struct {
+	action   RateAction
+	clock    Clock
+	msgs     bucket
+	bytes    bucket
+	dropping bool
+}
+
+// newRateLimit returns nil if conf sets no limits
+func newRateLimit(conf RateConfig) *rateLimit {
+	if conf.Messages <= 0 && conf.Bytes <= 0 {
+		return nil
+	}
+
+	l := &rateLimit{action: conf.Action, clock: conf.Clock}
+	if l.clock == nil {
+		l.clock = systemClock{}
+	}
+
+	now := l.clock.Now()
+	l.msgs = newBucket(conf.Messages, conf.MessageBurst, now)
+	l.bytes = newBucket(conf.Bytes, conf.ByteBurst, now)
+	return l
+}
+
+// check reports whether the frame with header h should be skipped,
+// delaying until it is allowed under RateDelay or failing with
+// ErrRateLimited under RateClose
+func (l *rateLimit) check(h *FrameHeader) (skip bool, err error) {
+	if h.Opcode == OpcodeClose {
+		return
+	}
+
+	size := float64(h.PL)
+
+	if h.Opcode == OpcodeCont {
+		l.bytes.take(size)
+		return l.dropping, nil
+	}
+
+	now := l.clock.Now()
+	l.msgs.refill(now)
+	l.bytes.refill(now)
+
+	if wait := max(l.msgs.wait(1), l.bytes.wait(size)); wait > 0 {
+		switch l.action {
+		case RateDrop:
+			if !isControl(h.Opcode) {
+				l.dropping = !h.FIN
+			}
+			return true, nil
+		case RateClose:
+			return false, ErrRateLimited
+		}
+
+		l.clock.Sleep(wait)
+
+		now = l.clock.Now()
+		l.msgs.refill(now)
+		l.bytes.refill(now)
+	}
+
+	l.msgs.take(1)
+	l.bytes.take(size)
+
+	if !isControl(h.Opcode) {
+		l.dropping = false
+	}
+
+	return
+}
+
+// delay returns how long RateDelay would hold the frame with header
+// h, without taking from the buckets, so that the event loop can
+// wait without holding a worker
+func (l *rateLimit) delay(h *FrameHeader) time.Duration {
+	if l.action != RateDelay || h.Opcode == OpcodeClose || h.Opcode == OpcodeCont {
+		return 0
+	}
+
+	now := l.clock.Now()
+	l.msgs.refill(now)
+	l.bytes.refill(now)
+
+	return max(l.msgs.wait(1), l.bytes.wait(float64(h.PL)))
+}
+
+// rateConfig returns the limits for connections upgraded on path
+func (conf *ServerConfig) rateConfig(path string) RateConfig {
+	if r, ok := conf.RouteRates[path]; ok {
+		return r
+	}
+	return conf.Rate
+}
@@ -0,0 +1,148 @@
+package ws_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+	"github.com/willmroliver/wsgo/test"
+)
+
+// rateConn returns a server Conn limited by conf, reading frames
+func rateConn(conf ws.RateConfig, frames ...*ws.Message) *ws.Conn {
+	var in bytes.Buffer
+	for _, m := range frames {
+		p, _ := m.EncodeBytes()
+		in.Write(p)
+	}
+
+	c, _ := ws.NewConn(test.NewConn(&in, new(bytes.Buffer)), ws.ServerConfig{Rate: conf})
+	return c
+}
+
+func textFrame(s string, fin bool) *ws.Message {
+	m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte(s))
+	m.FIN = fin
+	return m
+}
+
+func contFrame(s string) *ws.Message {
+	m := ws.NewMessage(ws.OpcodeCont).SetPayload([]byte(s))
+	m.FIN = true
+	return m
+}
+
+// expFrames decodes a frame from c for each of exp, failing unless
+// its payload matches
+func expFrames(t *testing.T, c *ws.Conn, exp ...string) {
+	t.Helper()
+
+	m := new(ws.Message)
+	for _, e := range exp {
+		if err := m.Decode(c); err != nil {
+			t.Fatal(err)
+		}
+		got := string(m.Payload)
+		if m.Opcode == ws.OpcodeClose {
+			got = "close"
+		}
+		if got != e {
+			t.Fatalf("exp %q, got %q\n", e, got)
+		}
+	}
+}
+
+func TestRateDrop(t *testing.T) {
+	clock := test.NewClock()
+
+	c := rateConn(
+		ws.RateConfig{Messages: 2, Action: ws.RateDrop, Clock: clock},
+		textFrame("a", true),
+		textFrame("b", true),
+		textFrame("c", true),
+		ws.CloseFrame,
+		textFrame("d", true),
+		textFrame("e", true),
+		textFrame("f", false),
+		contFrame("g"),
+		ws.CloseFrame,
+	)
+
+	// c is dropped, but the close frame is never limited
+	expFrames(t, c, "a", "b", "close")
+
+	// a refilled bucket allows two more messages, and the rest of a
+	// fragmented message is dropped with its first frame
+	clock.Advance(time.Second)
+	expFrames(t, c, "d", "e", "close")
+}
+
+func TestRateDelay(t *testing.T) {
+	clock := test.NewClock()
+	payload := string(bytes.Repeat([]byte{'x'}, 100))
+
+	c := rateConn(
+		ws.RateConfig{Bytes: 100, Clock: clock},
+		textFrame(payload, true),
+		textFrame(payload, false),
+		contFrame(payload),
+		textFrame(payload, true),
+	)
+
+	expFrames(t, c, payload, payload, payload, payload)
+
+	// the continuation overdraws the bucket rather than waiting
+	if slept := clock.Slept(); slept != 3*time.Second {
+		t.Errorf("exp reads delayed 3s, got %v\n", slept)
+	}
+}
+
+func TestRateClose(t *testing.T) {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Conf.RouteRates = map[string]ws.RateConfig{
+			"/chat": {Messages: 1, Action: ws.RateClose},
+		}
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			m.Encode(c)
+		})
+	})
+
+	// other routes are unlimited
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for range 3 {
+		if err := echo(c, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err = ws.Dial(url+"chat?room=1", ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, s := range []string{"a", "b"} {
+		m := ws.NewMessage(ws.OpcodeBinary).SetPayload([]byte(s))
+		m.FIN = true
+		if err := m.Encode(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := new(ws.Message)
+	if err := m.Decode(c); err != nil || string(m.Payload) != "a" {
+		t.Fatalf("exp first message echoed, got %q (%v)\n", m.Payload, err)
+	}
+	if err := m.Decode(c); err != nil {
+		t.Fatal(err)
+	}
+	if m.Opcode != ws.OpcodeClose || m.CloseStatus() != ws.StatusCodePolicyViolated {
+		t.Errorf("exp close with 1008, got opcode %d status %d\n", m.Opcode, m.CloseStatus())
+	}
+}
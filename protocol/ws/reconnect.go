@@ -0,0 +1,276 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type SendPolicy int
+
+const (
+	// SendReject fails sends with ErrNotConnected while down
+	SendReject SendPolicy = iota
+	// SendQueue buffers up to ReconnectConfig.QueueSize sends,
+	// flushing them once OnReconnect has succeeded
+	SendQueue
+)
+
+var (
+	ErrNotConnected = errors.New("client not connected")
+	ErrQueueFull    = errors.New("send queue full")
+	ErrClientClosed = errors.New("client closed")
+)
+
+// ReconnectConfig controls how a ReconnectingClient recovers
+// from abnormal closes.
+//
+// The delay before attempt n is MinBackoff * 2^(n-1), capped at
+// MaxBackoff, then reduced by a random fraction of up to Jitter.
+// MaxAttempts of 0 retries indefinitely.
+type ReconnectConfig struct {
+	MinBackoff, MaxBackoff time.Duration
+	Jitter                 float64
+	MaxAttempts            int
+
+	Policy    SendPolicy
+	QueueSize int
+
+	// OnReconnect runs after every successful handshake, including
+	// the first, before any queued sends are flushed. Returning an
+	// error drops the connection and schedules another attempt.
+	OnReconnect func(*ClientConn) error
+
+	// OnMessage receives each data frame read from the server
+	OnMessage func(*Message)
+}
+
+// ReconnectingClient wraps Dial, re-dialing with exponential
+// backoff whenever the connection ends without a 1000 close.
+type ReconnectingClient struct {
+	URL  string
+	Conf ClientConfig
+	Opts ReconnectConfig
+
+	// mu guards conn and the send queue, but is not held while
+	// writing, so a slow server cannot stall the read loop's replies
+	mu     sync.Mutex
+	conn   *ClientConn
+	queue  []*Message
+	closed bool
+}
+
+func NewReconnectingClient(
+	rawURL string,
+	conf ClientConfig,
+	opts ReconnectConfig,
+) *ReconnectingClient {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+
+	return &ReconnectingClient{
+		URL:  rawURL,
+		Conf: conf,
+		Opts: opts,
+	}
+}
+
+// Run dials and reads from the server until ctx is done, either
+// side closes with 1000, or MaxAttempts consecutive dials fail.
+func (r *ReconnectingClient) Run(ctx context.Context) (err error) {
+	for attempt := 0; ; {
+		var c *ClientConn
+
+		if c, err = Dial(r.URL, r.Conf); err == nil {
+			var status uint16
+			if err = r.connected(c); err == nil {
+				attempt = 0
+				status = r.read(ctx, c)
+			}
+
+			r.disconnected(c)
+
+			if status == StatusCodeNormalClosure {
+				return nil
+			}
+		}
+
+		if r.isClosed() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		attempt++
+		if r.Opts.MaxAttempts > 0 && attempt > r.Opts.MaxAttempts {
+			return
+		}
+
+		t := time.NewTimer(r.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Send writes m to the current connection, queueing or rejecting
+// it according to Opts.Policy while the client is reconnecting.
+func (r *ReconnectingClient) Send(m *Message) error {
+	r.mu.Lock()
+
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClientClosed
+	}
+
+	if c := r.conn; c != nil {
+		r.mu.Unlock()
+		return m.Encode(c)
+	}
+
+	defer r.mu.Unlock()
+
+	if r.Opts.Policy != SendQueue {
+		return ErrNotConnected
+	}
+
+	if len(r.queue) >= r.Opts.QueueSize {
+		return ErrQueueFull
+	}
+
+	r.queue = append(r.queue, m)
+	return nil
+}
+
+// Close sends a 1000 close to the server and stops reconnecting
+func (r *ReconnectingClient) Close() (err error) {
+	r.mu.Lock()
+	c := r.conn
+	r.closed, r.conn, r.queue = true, nil, nil
+	r.mu.Unlock()
+
+	if c != nil {
+		NewCloseFrame(StatusCodeNormalClosure, "").Encode(c)
+		err = c.Conn.Close()
+	}
+
+	return
+}
+
+func (r *ReconnectingClient) connected(c *ClientConn) (err error) {
+	if r.Opts.OnReconnect != nil {
+		if err = r.Opts.OnReconnect(c); err != nil {
+			return
+		}
+	}
+
+	// sends made while flushing join the queue, behind those before
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return ErrClientClosed
+		}
+		if len(r.queue) == 0 {
+			r.conn = c
+			r.mu.Unlock()
+			return
+		}
+		m := r.queue[0]
+		r.mu.Unlock()
+
+		if err = m.Encode(c); err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if len(r.queue) > 0 && r.queue[0] == m {
+			r.queue = r.queue[1:]
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *ReconnectingClient) disconnected(c *ClientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == c {
+		r.conn = nil
+	}
+
+	c.Conn.Close()
+}
+
+func (r *ReconnectingClient) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closed
+}
+
+// read handles frames until the connection ends, returning the
+// close status, or 1006 if the connection dropped without one
+func (r *ReconnectingClient) read(ctx context.Context, c *ClientConn) uint16 {
+	stop := context.AfterFunc(ctx, func() {
+		c.Conn.Close()
+	})
+	defer stop()
+
+	for {
+		m := new(Message)
+		if err := m.Decode(c); err != nil {
+			return StatusCodeAbnormalClosure
+		}
+
+		switch m.Opcode {
+		case OpcodeClose:
+			status := m.CloseStatus()
+
+			// a close without a status is echoed without one, as
+			// 1005 may not be sent
+			reply := CloseFrame
+			if status != StatusCodeNoStatus {
+				reply = NewCloseFrame(status, "")
+			}
+
+			reply.Encode(c)
+
+			return status
+		case OpcodePing:
+			pong := NewMessage(OpcodePong).SetPayload(m.Payload)
+			pong.FIN = true
+
+			pong.Encode(c)
+		case OpcodePong:
+		default:
+			if r.Opts.OnMessage != nil {
+				r.Opts.OnMessage(m)
+			}
+		}
+	}
+}
+
+func (r *ReconnectingClient) backoff(attempt int) time.Duration {
+	d := r.Opts.MinBackoff
+	for i := 1; i < attempt && d < r.Opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, r.Opts.MaxBackoff)
+
+	if j := min(max(r.Opts.Jitter, 0), 1); j > 0 {
+		d -= time.Duration(rand.Float64() * j * float64(d))
+	}
+
+	return d
+}
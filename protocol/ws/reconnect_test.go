@@ -0,0 +1,212 @@
+package ws_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// frameServer upgrades each accepted connection and hands it,
+// with its buffered reader, to the next step in script
+func frameServer(
+	t *testing.T,
+	script []func(net.Conn, *bufio.Reader),
+) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for _, step := range script {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			if _, err = http.ReadRequest(r); err != nil {
+				conn.Close()
+				return
+			}
+
+			conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+				"Upgrade: websocket\r\n" +
+				"Connection: Upgrade\r\n" +
+				"\r\n"))
+
+			step(conn, r)
+		}
+	}()
+
+	return l
+}
+
+func writeFrame(w io.Writer, m *ws.Message) {
+	m.FIN = true
+	data, _ := m.EncodeBytes()
+	w.Write(data)
+}
+
+func TestReconnectingClient(t *testing.T) {
+	received := make(chan []byte, 1)
+
+	l := frameServer(t, []func(net.Conn, *bufio.Reader){
+		func(c net.Conn, r *bufio.Reader) {
+			b := make([]byte, 8)
+			io.ReadFull(r, b)
+
+			// client frames arrive masked
+			for i := range b[6:] {
+				b[6+i] ^= b[2+i%4]
+			}
+			received <- append(b[:2:2], b[6:]...)
+
+			writeFrame(c, ws.NewCloseFrame(ws.StatusCodeGoingAway, ""))
+			io.ReadAll(r)
+			c.Close()
+		},
+		func(c net.Conn, r *bufio.Reader) {
+			c.Close()
+		},
+		func(c net.Conn, r *bufio.Reader) {
+			writeFrame(c, ws.NewMessage(ws.OpcodeText).SetPayload([]byte("hello")))
+			writeFrame(c, ws.NewCloseFrame(ws.StatusCodeNormalClosure, ""))
+			io.ReadAll(r)
+			c.Close()
+		},
+	})
+	defer l.Close()
+
+	var reconnects atomic.Int32
+	messages := make(chan string, 1)
+
+	r := ws.NewReconnectingClient("ws://"+l.Addr().String()+"/", ws.ClientConfig{}, ws.ReconnectConfig{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 4 * time.Millisecond,
+		Jitter:     0.5,
+		Policy:     ws.SendQueue,
+		QueueSize:  1,
+		OnReconnect: func(c *ws.ClientConn) error {
+			reconnects.Add(1)
+			return nil
+		},
+		OnMessage: func(m *ws.Message) {
+			messages <- string(m.Payload)
+		},
+	})
+
+	msg := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("hi"))
+	msg.FIN = true
+
+	if err := r.Send(msg); err != nil {
+		t.Errorf("exp queued, got %v\n", err)
+		return
+	}
+	if err := r.Send(msg); err != ws.ErrQueueFull {
+		t.Errorf("exp %v, got %v\n", ws.ErrQueueFull, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := r.Run(ctx); err != nil {
+		t.Errorf("Run: exp nil, got %v\n", err)
+		return
+	}
+
+	if exp, got := int32(3), reconnects.Load(); exp != got {
+		t.Errorf("exp %d connections, got %d\n", exp, got)
+	}
+	if exp, got := []byte{0x81, 0x80 | 2, 'h', 'i'}, <-received; !slices.Equal(exp, got) {
+		t.Errorf("exp %v, got %v\n", exp, got)
+	}
+	if exp, got := "hello", <-messages; exp != got {
+		t.Errorf("exp %q, got %q\n", exp, got)
+	}
+}
+
+func TestReconnectingClientReject(t *testing.T) {
+	r := ws.NewReconnectingClient("ws://127.0.0.1:1/", ws.ClientConfig{}, ws.ReconnectConfig{
+		MinBackoff:  time.Millisecond,
+		MaxAttempts: 2,
+	})
+
+	if err := r.Send(ws.NewMessage(ws.OpcodeText)); err != ws.ErrNotConnected {
+		t.Errorf("exp %v, got %v\n", ws.ErrNotConnected, err)
+	}
+
+	if err := r.Run(context.Background()); err == nil {
+		t.Errorf("exp dial error, got nil\n")
+	}
+
+	r.Close()
+
+	if err := r.Send(ws.NewMessage(ws.OpcodeText)); err != ws.ErrClientClosed {
+		t.Errorf("exp %v, got %v\n", ws.ErrClientClosed, err)
+	}
+}
+
+func TestReconnectingClientCloseNoStatus(t *testing.T) {
+	replies := make(chan []byte, 2)
+
+	// reply reads the client's close frame, unmasking its payload
+	reply := func(c net.Conn, r *bufio.Reader) {
+		b := make([]byte, 6)
+		io.ReadFull(r, b)
+
+		p := make([]byte, b[1]&0x7f)
+		io.ReadFull(r, p)
+		for i := range p {
+			p[i] ^= b[2+i%4]
+		}
+		replies <- append(b[:1:1], p...)
+
+		// the client closes its end once the handshake completes
+		io.ReadAll(r)
+		c.Close()
+	}
+
+	l := frameServer(t, []func(net.Conn, *bufio.Reader){
+		func(c net.Conn, r *bufio.Reader) {
+			writeFrame(c, ws.CloseFrame)
+			reply(c, r)
+		},
+		func(c net.Conn, r *bufio.Reader) {
+			writeFrame(c, ws.NewCloseFrame(ws.StatusCodeNormalClosure, ""))
+			reply(c, r)
+		},
+	})
+	defer l.Close()
+
+	r := ws.NewReconnectingClient("ws://"+l.Addr().String()+"/", ws.ClientConfig{}, ws.ReconnectConfig{
+		MinBackoff: time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := r.Run(ctx); err != nil {
+		t.Fatalf("Run: exp nil, got %v\n", err)
+	}
+
+	if err := r.Send(ws.NewMessage(ws.OpcodeText)); err != ws.ErrNotConnected {
+		t.Errorf("exp %v after Run, got %v\n", ws.ErrNotConnected, err)
+	}
+
+	if exp, got := []byte{0x88}, <-replies; !slices.Equal(exp, got) {
+		t.Errorf("exp close without status, got %v\n", got)
+	}
+	if exp, got := []byte{0x88, 0x03, 0xe8}, <-replies; !slices.Equal(exp, got) {
+		t.Errorf("exp close echoing 1000, got %v\n", got)
+	}
+}
@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// InheritEnv names the environment variable through which Handoff
+// passes listeners to a new process: the number of listeners,
+// inherited as consecutive descriptors from fd 3
+const InheritEnv = "WSGO_LISTEN_FDS"
+
+// listenFDsStart is the first inherited descriptor, after stdio
+const listenFDsStart = 3
+
+// drainInterval is how often Drain checks for remaining connections
+const drainInterval = 10 * time.Millisecond
+
+var ErrNoListenerFile = errors.New("listener cannot export its file")
+
+// Handoff starts cmd, typically a new version of the running binary,
+// with s's listening sockets as inherited descriptors, ready to be
+// picked up by Inherit. Both processes accept from the sockets until
+// s stops, usually with Drain.
+func (s *Server) Handoff(cmd *exec.Cmd) (err error) {
+	ls := s.Listeners
+	if len(ls) == 0 {
+		ls = []net.Listener{s.Listener}
+	}
+
+	files := make([]*os.File, 0, len(ls))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range ls {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return ErrNoListenerFile
+		}
+
+		var f *os.File
+		if f, err = fl.File(); err != nil {
+			return
+		}
+
+		files = append(files, f)
+	}
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+
+	cmd.Env = append(cmd.Env, InheritEnv+"="+strconv.Itoa(len(files)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles[:0:0], files...)
+
+	return cmd.Start()
+}
+
+// Inherit returns a Server accepting from the listeners passed by
+// Handoff, or else listening on network and address as Listen does
+func Inherit(network, address string) (*Server, error) {
+	n, err := strconv.Atoi(os.Getenv(InheritEnv))
+	if err != nil || n <= 0 {
+		return Listen(network, address)
+	}
+
+	os.Unsetenv(InheritEnv)
+
+	fds := make([]int, n)
+	for i := range fds {
+		fds[i] = listenFDsStart + i
+	}
+
+	ls, err := fileListeners(fds, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServerListeners(ls...)
+}
+
+// fileListeners wraps inherited descriptors, named by names if
+// given, closing the originals
+func fileListeners(fds []int, names []string) (ls []net.Listener, err error) {
+	for i, fd := range fds {
+		name := "listener"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+
+		var l net.Listener
+		l, err = net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		ls = append(ls, l)
+	}
+
+	return
+}
+
+// Drain stops accepting connections and waits for those open to
+// close. Any still open when ctx is done are closed with 1001
+// (going away), and ctx's error is returned.
+func (s *Server) Drain(ctx context.Context) error {
+	ls := s.Listeners
+	if len(ls) == 0 {
+		ls = []net.Listener{s.Listener}
+	}
+
+	for _, l := range ls {
+		l.Close()
+	}
+
+	t := time.NewTicker(drainInterval)
+	defer t.Stop()
+
+	for {
+		s.mu.RLock()
+		n := len(s.Conns)
+		s.mu.RUnlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			s.closeAll(StatusCodeGoingAway, "server restarting")
+			return ctx.Err()
+		}
+	}
+}
+
+// closeAll closes every registered connection with status
+func (s *Server) closeAll(status uint16, reason string) {
+	s.mu.RLock()
+	conns := make([]*Conn, 0, len(s.Conns))
+	for _, c := range s.Conns {
+		conns = append(conns, c.(*Conn))
+	}
+	s.mu.RUnlock()
+
+	for _, c := range conns {
+		c.closeWith(status, reason)
+	}
+}
@@ -0,0 +1,124 @@
+package ws_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// TestHandoffChild is the new process started by TestHandoff: it
+// serves from the inherited listener until its stdin closes
+func TestHandoffChild(t *testing.T) {
+	if os.Getenv("WSGO_TEST_HANDOFF") == "" {
+		t.Skip("run by TestHandoff")
+	}
+
+	s, err := ws.Inherit("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+		ws.NewMessage(m.Opcode).SetPayload(append([]byte("child "), m.Payload...)).Encode(c)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+
+	defer cancel()
+
+	fmt.Println("ready", s.Listener.Addr())
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+func TestHandoff(t *testing.T) {
+	s, err := ws.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+		ws.NewMessage(m.Opcode).SetPayload(append([]byte("parent "), m.Payload...)).Encode(c)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+
+	defer cancel()
+
+	url := "ws://" + s.Listener.Addr().String() + "/"
+
+	old, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffChild$")
+	cmd.Env = append(os.Environ(), "WSGO_TEST_HANDOFF=1")
+
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+
+	if err := s.Handoff(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if exp := "ready " + s.Listener.Addr().String() + "\n"; line != exp {
+		t.Fatalf("exp child %q, got %q (%v)\n", exp, line, err)
+	}
+
+	drained := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		drained <- s.Drain(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// new connections reach the child, while the old one is still
+	// served by the draining parent until it closes
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	for _, test := range []struct {
+		c   *ws.ClientConn
+		exp string
+	}{
+		{c, "child hi"},
+		{old, "parent hi"},
+	} {
+		m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("hi"))
+		m.FIN = true
+		m.Encode(test.c)
+
+		if err := m.Decode(test.c); err != nil || string(m.Payload) != test.exp {
+			t.Errorf("exp %q, got %q (%v)\n", test.exp, m.Payload, err)
+		}
+	}
+
+	ws.NewCloseFrame(ws.StatusCodeNormalClosure, "").Encode(old)
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("exp drain once the old connection closed, got %v\n", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("exp drain to return\n")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package ws
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which package syscall does not
+// define on every Linux architecture
+const soReusePort = 0xf
+
+func reusePort(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return
+}
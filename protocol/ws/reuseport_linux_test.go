@@ -0,0 +1,48 @@
+package ws_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func TestListenReusePort(t *testing.T) {
+	s, err := ws.ListenReusePort("tcp4", "127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Listeners) != 4 {
+		t.Fatalf("exp 4 listeners, got %d\n", len(s.Listeners))
+	}
+
+	for _, l := range s.Listeners {
+		defer l.Close()
+
+		if l.Addr().String() != s.Listener.Addr().String() {
+			t.Errorf("exp shared address %s, got %s\n", s.Listener.Addr(), l.Addr())
+		}
+	}
+
+	s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+		ws.NewMessage(m.Opcode).SetPayload(m.Payload).Encode(c)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+
+	defer cancel()
+
+	for range 20 {
+		c, err := ws.Dial("ws://"+s.Listener.Addr().String()+"/", ws.ClientConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Conn.Close()
+
+		if err := echo(c, []byte("sharded")); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package ws
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort(string, string, syscall.RawConn) error {
+	return errors.ErrUnsupported
+}
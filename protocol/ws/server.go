@@ -2,88 +2,368 @@ package ws
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/willmroliver/wsgo/core"
 )
 
-var inc uint = 0
+var inc atomic.Uint64
 
+var ErrNoListeners = errors.New("no listeners")
+
+// ServerConfig is applied to each accepted connection.
 type ServerConfig struct {
-	Path        string
+	// Path, if set, must match the request path, without its query
+	Path string
+
+	// ConnBufSize is the read buffer capacity, a power of two, or 0
+	// for DefaultBufSize
 	ConnBufSize uint
+
+	// SharedBufs borrows read buffers from a shared pool only while
+	// bytes are unread, as Server.Poll always does
+	SharedBufs bool
+
+	// WriteBufSize, if positive, sets the socket send buffer
+	WriteBufSize int
+
 	ConnTimeout time.Duration
+
+	// HandshakeTimeout bounds the whole opening handshake, including
+	// any PROXY header and TLS, or 0 for DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+
+	// Queue optionally moves writes onto a per-connection goroutine
+	Queue QueueConfig
+
+	// Proxy recovers client addresses from trusted load balancers
+	Proxy ProxyConfig
+
+	// Rate limits the frames read from each connection, unless
+	// RouteRates has an entry for the request path
+	Rate       RateConfig
+	RouteRates map[string]RateConfig
+
+	// Access filters peers once accepted, before anything is read
+	Access *AccessList
+
+	// Auth requires a signed token in each handshake
+	Auth *TokenAuth
+
+	// OnHandshake may refuse a handshake after Auth accepts it
+	OnHandshake HandshakeHook
+}
+
+// Validate reports ErrBufSize if ConnBufSize is not a power of two
+func (conf *ServerConfig) Validate() error {
+	return checkBufSize(conf.ConnBufSize)
+}
+
+// PollConfig enables an epoll event loop, on Linux only, when
+// Workers is positive. Idle connections then hold no goroutine and
+// no read buffer: frames are decoded on a pool of Workers goroutines
+// once they have arrived in full. A frame larger than the read
+// buffer is read on a goroutine of its own.
+type PollConfig struct {
+	Workers int
 }
 
+// Server accepts connections and completes their handshakes. If
+// Handler is set, frames are then read from each connection, on a
+// goroutine per connection or on the event loop enabled by Poll,
+// which falls back to goroutines where epoll is unavailable.
+// Dispatch optionally moves the Handler onto a worker pool, and
+// Limits bounds the connections upgraded.
+//
+// Run accepts from each of Listeners, if set, in its own loop, and
+// otherwise from Listener. TLS, if set, serves every connection over
+// TLS, following any PROXY header: set its ClientAuth and ClientCAs
+// to require verified client certificates. The event loop is not
+// used for TLS connections.
 type Server struct {
 	Port      int
-	Listener  *net.TCPListener
+	Listener  net.Listener
+	Listeners []net.Listener
 	KeepAlive net.KeepAliveConfig
+	NoDelay   bool
+	TLS       *tls.Config
 	Conf      ServerConfig
 	Conns     map[uint]core.Conn
+	Handler   Handler
+	Poll      PollConfig
+	Dispatch  DispatchConfig
+	Limits    LimitConfig
+
+	mu         sync.RWMutex
+	limits     limiter
+	poller     *poller
+	dispatcher *dispatcher
 }
 
+// NewServer listens on port on all interfaces, dual-stack where
+// the platform supports it
 func NewServer(port int) (s *Server, err error) {
-	s = &Server{
-		Port:  port,
-		Conns: make(map[uint]core.Conn),
+	return Listen("tcp", net.JoinHostPort("::", strconv.Itoa(port)))
+}
+
+// Listen opens a listener with net.Listen and returns a Server
+// accepting from it. network selects e.g. "tcp" (dual-stack),
+// "tcp4", "tcp6" or "unix", and address may include a bind IP.
+func Listen(network, address string) (s *Server, err error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return
 	}
 
-	s.Listener, err = net.ListenTCP("tcp", &net.TCPAddr{
-		IP:   net.IPv6unspecified,
-		Port: port,
-		Zone: "",
-	})
+	s = NewServerListener(l)
+	return
+}
+
+// ListenReusePort opens n listeners on the same address with
+// SO_REUSEPORT, so that the kernel balances new connections across
+// their accept loops, which share one registry and Handler. It
+// returns errors.ErrUnsupported where SO_REUSEPORT is unavailable.
+func ListenReusePort(network, address string, n int) (s *Server, err error) {
+	lc := net.ListenConfig{Control: reusePort}
+	ls := make([]net.Listener, 0, max(n, 1))
+
+	defer func() {
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+		}
+	}()
+
+	for range cap(ls) {
+		var l net.Listener
+		if l, err = lc.Listen(context.Background(), network, address); err != nil {
+			return
+		}
+
+		// later listeners must bind the port chosen for the first
+		address = l.Addr().String()
+		ls = append(ls, l)
+	}
+
+	return NewServerListeners(ls...)
+}
+
+// NewServerListener returns a Server accepting from any listener.
+//
+// KeepAlive and NoDelay are applied to accepted connections
+// which support them, such as *net.TCPConn.
+func NewServerListener(l net.Listener) *Server {
+	s := &Server{
+		Listener: l,
+		NoDelay:  true,
+		Conns:    make(map[uint]core.Conn),
+	}
+
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		s.Port = addr.Port
+	}
 
 	s.KeepAlive.Enable = true
-	return
+	return s
 }
 
-func (s *Server) Run(ctx context.Context) {
+// NewServerListeners returns a Server accepting from each of ls,
+// failing with ErrNoListeners if there are none
+func NewServerListeners(ls ...net.Listener) (*Server, error) {
+	if len(ls) == 0 {
+		return nil, ErrNoListeners
+	}
+
+	s := NewServerListener(ls[0])
+	s.Listeners = ls
+	return s, nil
+}
+
+// Run accepts connections until ctx is done or its listeners are
+// closed, failing at once if s.Conf is invalid
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Conf.Validate(); err != nil {
+		return err
+	}
+
+	if s.Handler != nil && s.Poll.Workers > 0 {
+		if p, err := newPoller(s, s.Poll.Workers); err == nil {
+			s.poller = p
+			defer p.close()
+		}
+	}
+
+	if s.Handler != nil && s.Dispatch.Workers > 0 {
+		s.dispatcher = newDispatcher(s.Handler, s.Dispatch)
+		defer s.dispatcher.close()
+	}
+
+	ls := s.Listeners
+	if len(ls) == 0 {
+		ls = []net.Listener{s.Listener}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(ls))
+
+	for _, l := range ls {
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(ctx, l, &wg)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// acceptLoop hands each connection accepted from l to its own
+// handshake, counted by wg, so a stalled peer delays no other
+func (s *Server) acceptLoop(ctx context.Context, l net.Listener, wg *sync.WaitGroup) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			conn, err := s.Accept()
+			conn, err := s.accept(l)
 			if err != nil {
-				if ctx.Err() != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
 					return
 				}
 				// @todo - handle error
 				continue
 			}
 
-			if err = conn.Handshake(); err != nil {
-				conn.Close()
-			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handshake(ctx, conn)
+			}()
 		}
 	}
 }
 
+// handshake completes c's opening handshake and serves it, unless
+// ctx is done first
+func (s *Server) handshake(ctx context.Context, c *Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		c.Conn.Close()
+	})
+
+	if err := c.Handshake(); !stop() || err != nil {
+		c.Close()
+		return
+	}
+
+	s.serve(c)
+}
+
+// Accept waits for the next connection, failing without accepting
+// if s.Conf is invalid
 func (s *Server) Accept() (core.Conn, error) {
-	conn, err := s.Listener.AcceptTCP()
+	if err := s.Conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	c, err := s.accept(s.Listener)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (s *Server) accept(l net.Listener) (*Conn, error) {
+	conn, err := l.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	inc++
+	if !s.Conf.Access.allowsAddr(conn.RemoteAddr()) {
+		conn.Close()
+		return nil, ErrAccessDenied
+	}
+
+	if tc, ok := conn.(interface {
+		SetKeepAliveConfig(net.KeepAliveConfig) error
+	}); ok {
+		tc.SetKeepAliveConfig(s.KeepAlive)
+	}
+	if tc, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		tc.SetNoDelay(s.NoDelay)
+	}
 
-	c := &Conn{
-		TCPConn: conn,
-		ConnID:  inc,
-		Server:  s,
+	if s.TLS != nil {
+		conn = serveTLS(conn, s.TLS)
+	}
 
-		buf: core.NewRingBuf(0x1000, conn),
+	conf := s.Conf
+	if s.poller != nil {
+		conf.SharedBufs = true
 	}
 
-	c.SetKeepAliveConfig(s.KeepAlive)
-	s.Conns[inc] = c
+	c, err := NewConn(conn, conf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.ConnID = uint(inc.Add(1))
+	c.Server = s
+
+	s.mu.Lock()
+	s.Conns[c.ConnID] = c
+	s.mu.Unlock()
+
 	return c, nil
 }
 
 func (s *Server) Close(c core.Conn) error {
-	delete(s.Conns, c.(*Conn).ConnID)
+	cc := c.(*Conn)
+
+	s.mu.Lock()
+	delete(s.Conns, cc.ConnID)
+	admitted := cc.admitted
+	cc.admitted = false
+	s.mu.Unlock()
+
+	if admitted {
+		s.limits.release(cc.limitKey)
+	}
+
+	if s.poller != nil {
+		s.poller.remove(cc)
+	}
+
 	return nil
 }
+
+// Broadcast writes m to every open connection, returning the first
+// error encountered. Use a PreparedMessage to encode m only once.
+func (s *Server) Broadcast(m core.Message) (err error) {
+	s.mu.RLock()
+	conns := make([]core.Conn, 0, len(s.Conns))
+	for _, c := range s.Conns {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+
+	// writes may block, so are made without holding s.mu
+	for _, c := range conns {
+		if !c.Open() {
+			continue
+		}
+		if werr := m.Encode(c); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/willmroliver/wsgo/core"
 	"github.com/willmroliver/wsgo/protocol/ws"
 )
 
@@ -57,7 +61,7 @@ func TestServerRun(t *testing.T) {
 	exp := "HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
 		"Connection: Upgrade\r\n" +
-		"Sec-Websocket-Accept: Kfh9QIsMVZcl6xEPYxPHzW8SZ8w=\r\n" +
+		"Sec-Websocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n" +
 		"\r\n"
 
 	if m := len(exp); n != m {
@@ -71,3 +75,221 @@ func TestServerRun(t *testing.T) {
 	// go maps are unpredictably ordered so, should build some
 	// http utilities for testing req/res equality
 }
+
+func TestHandshakeConcurrent(t *testing.T) {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Conf.HandshakeTimeout = 5 * time.Second
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			m.Encode(c)
+		})
+	})
+
+	// a peer which never sends its request
+	idle, err := net.Dial("tcp", strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	start := time.Now()
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("exp handshake not delayed by an idle peer, took %v\n", d)
+	}
+	if err := echo(c, []byte("hi")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ws.sock")
+
+	s, err := ws.Listen("unix", sock)
+	if err != nil {
+		t.Errorf("exp nil, got %q\n", err)
+		return
+	}
+	defer s.Listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+
+	defer cancel()
+
+	c, err := ws.Dial("ws://sidecar/chat", ws.ClientConfig{
+		Proxy: ws.ProxyURL(nil),
+		NetDial: func(string, string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Conn.Close()
+
+	if !c.Open() {
+		t.Errorf("exp open, got closed\n")
+	}
+}
+
+func TestWrapPipe(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	srv := ws.WrapConn(a)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- srv.Handshake()
+	}()
+
+	c := ws.WrapClientConn(b, "example.com", "/")
+	if err := c.Handshake(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := <-done; err != nil || !srv.Open() {
+		t.Errorf("exp open, got %v\n", err)
+	}
+}
+
+func TestConnBufSize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ws.NewServerListener(l)
+	defer l.Close()
+
+	s.Conf.ConnBufSize = 0x300
+	if _, err := s.Accept(); err != ws.ErrBufSize {
+		t.Errorf("exp %v, got %v\n", ws.ErrBufSize, err)
+		return
+	}
+
+	// Run fails before accepting anything
+	if err := s.Run(context.Background()); err != ws.ErrBufSize {
+		t.Errorf("Run: exp %v, got %v\n", ws.ErrBufSize, err)
+		return
+	}
+
+	if _, err := ws.NewConn(nil, s.Conf); err != ws.ErrBufSize {
+		t.Errorf("NewConn: exp %v, got %v\n", ws.ErrBufSize, err)
+		return
+	}
+
+	s.Conf.ConnBufSize = 0x100
+
+	go net.Dial("tcp", l.Addr().String())
+
+	conn, err := s.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	buf := conn.Buf().(*core.RingBuf)
+	if exp := uint(0x100); buf.Cap() != exp {
+		t.Errorf("exp %d, got %d\n", exp, buf.Cap())
+	}
+
+	c := conn.(*ws.Conn)
+	buf.Write([]byte("buffered"))
+
+	if err := c.SetBufSize(0x10000); err != nil || buf.Cap() != 0x10000 {
+		t.Errorf("grow: exp 0x10000, got (%d, %v)\n", buf.Cap(), err)
+	}
+	if err := c.SetBufSize(0x6); err != ws.ErrBufSize {
+		t.Errorf("exp %v, got %v\n", ws.ErrBufSize, err)
+	}
+	if err := c.SetBufSize(0x8); err != nil || buf.Cap() != 0x8 {
+		t.Errorf("shrink: exp 0x8, got (%d, %v)\n", buf.Cap(), err)
+	}
+
+	data := make([]byte, 8)
+	if buf.Read(data); string(data) != "buffered" {
+		t.Errorf("exp buffered, got %s\n", data)
+	}
+
+	if _, err := ws.Dial("ws://127.0.0.1:1/", ws.ClientConfig{
+		ConnBufSize: 1000,
+	}); err != ws.ErrBufSize {
+		t.Errorf("exp %v, got %v\n", ws.ErrBufSize, err)
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	s, err := ws.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+
+	if addr := s.Listener.Addr().(*net.TCPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || s.Port != addr.Port {
+		t.Errorf("exp bound to 127.0.0.1:%d, got %s\n", s.Port, addr)
+	}
+
+	if _, err := ws.Listen("tcp4", "[::1]:0"); err == nil {
+		t.Errorf("exp tcp4 to refuse an IPv6 address\n")
+	}
+}
+
+func TestNewServerListeners(t *testing.T) {
+	if _, err := ws.NewServerListeners(); err != ws.ErrNoListeners {
+		t.Errorf("exp %v, got %v\n", ws.ErrNoListeners, err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	s, url := runServer(t, func(s *ws.Server) {
+		s.Handler = ws.HandlerFunc(func(*ws.Conn, *ws.Message) {})
+	})
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// concurrent drains close each connection once
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Drain(ctx)
+		}()
+	}
+	wg.Wait()
+
+	if err := <-errs; err != context.DeadlineExceeded {
+		if err = <-errs; err != context.DeadlineExceeded {
+			t.Errorf("exp %v, got %v\n", context.DeadlineExceeded, err)
+		}
+	}
+
+	m := new(ws.Message)
+	if err := m.Decode(c); err != nil || m.CloseStatus() != ws.StatusCodeGoingAway {
+		t.Errorf("exp close 1001, got %d (%v)\n", m.CloseStatus(), err)
+	}
+	if err := m.Decode(c); err == nil {
+		t.Errorf("exp connection closed after one close frame, got opcode %d\n", m.Opcode)
+	}
+}
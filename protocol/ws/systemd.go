@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoSystemdSocket is returned by ListenSystemd when sockets were
+// passed to the process, but none remain unused with the name asked
+var ErrNoSystemdSocket = errors.New("no matching systemd socket")
+
+// systemdUsed holds the activated descriptors already wrapped in a
+// listener, which have since been closed
+var systemdUsed struct {
+	mu  sync.Mutex
+	fds map[int]bool
+}
+
+// ListenSystemd returns a Server accepting from the sockets passed
+// by systemd socket activation, as described by LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES.
+//
+// If name is non-empty, only sockets with that FileDescriptorName
+// are used. Each socket is used once: later calls skip it, so that
+// other servers in the process can select their own sockets by name
+// from the environment left in place. If no sockets were passed to
+// this process, it listens on network and address as Listen does,
+// but if none remain which match name it fails with
+// ErrNoSystemdSocket.
+func ListenSystemd(name, network, address string) (*Server, error) {
+	fds, names, ok := systemdFDs(name)
+	if !ok {
+		return Listen(network, address)
+	}
+	if len(fds) == 0 {
+		return nil, ErrNoSystemdSocket
+	}
+
+	ls, err := fileListeners(fds, names)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServerListeners(ls...)
+}
+
+// systemdFDs claims the unused activated descriptors named name, or
+// all of them if name is empty. ok reports whether any sockets were
+// passed to this process.
+func systemdFDs(name string) (fds []int, names []string, ok bool) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+
+	all := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	systemdUsed.mu.Lock()
+	defer systemdUsed.mu.Unlock()
+
+	if systemdUsed.fds == nil {
+		systemdUsed.fds = make(map[int]bool)
+	}
+
+	for i := range n {
+		fd, fdName := listenFDsStart+i, ""
+		if i < len(all) {
+			fdName = all[i]
+		}
+
+		if !systemdUsed.fds[fd] && (name == "" || fdName == name) {
+			systemdUsed.fds[fd] = true
+			fds = append(fds, fd)
+			names = append(names, fdName)
+		}
+	}
+
+	return fds, names, true
+}
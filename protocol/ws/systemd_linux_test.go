@@ -0,0 +1,113 @@
+package ws_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// TestSystemdChild is started by TestListenSystemd with two sockets
+// inherited as systemd would pass them
+func TestSystemdChild(t *testing.T) {
+	if os.Getenv("LISTEN_FDS") == "" {
+		t.Skip("run by TestListenSystemd")
+	}
+
+	// systemd sets LISTEN_PID between fork and exec
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	s, err := ws.ListenSystemd("public", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(len(s.Listeners), s.Listener.Addr())
+
+	// a socket already used, or one never passed, is an error
+	for _, name := range []string{"public", "metrics"} {
+		if _, err := ws.ListenSystemd(name, "tcp", "127.0.0.1:0"); err != ws.ErrNoSystemdSocket {
+			t.Fatalf("%s: exp %v, got %v\n", name, ws.ErrNoSystemdSocket, err)
+		}
+	}
+
+	// while any others remain
+	if s, err = ws.ListenSystemd("", "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(len(s.Listeners), s.Listener.Addr())
+}
+
+func TestListenSystemd(t *testing.T) {
+	var files []*os.File
+
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		files = append(files, f)
+		addrs[i] = l.Addr().String()
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdChild$")
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=2", "LISTEN_FDNAMES=admin:public")
+	cmd.ExtraFiles = files
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	r := bufio.NewReader(out)
+
+	line, _ := r.ReadString('\n')
+	if exp := "1 " + addrs[1] + "\n"; line != exp {
+		t.Errorf("exp the socket named public, %q, got %q\n", exp, line)
+	}
+
+	line, _ = r.ReadString('\n')
+	if exp := "1 " + addrs[0] + "\n"; line != exp {
+		t.Errorf("exp the remaining socket, %q, got %q\n", exp, line)
+	}
+}
+
+func TestListenSystemdFallback(t *testing.T) {
+	for _, env := range [][2]string{
+		{"LISTEN_PID", ""},
+		{"LISTEN_PID", "1"},
+	} {
+		t.Setenv("LISTEN_FDS", "1")
+		t.Setenv(env[0], env[1])
+
+		s, err := ws.ListenSystemd("", "tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if addr := s.Listener.Addr().(*net.TCPAddr); !addr.IP.IsLoopback() || addr.Port == 0 {
+			t.Errorf("%s=%q: exp a new listener, got %s\n", env[0], env[1], addr)
+		}
+
+		s.Listener.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+
+	"github.com/willmroliver/wsgo/core"
+)
+
+// HandshakeHook inspects an upgrade request for target once its
+// client has been identified, by TLS, Conf.Proxy and Conf.Auth,
+// refusing it with 403 Forbidden if it returns an error
+type HandshakeHook func(c *Conn, target string, header func(string) string) error
+
+// rewindConn replays bytes read ahead of a TLS handshake, such as
+// those following a PROXY header, before reading from conn
+type rewindConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *rewindConn) Read(p []byte) (n int, err error) {
+	if len(c.pending) > 0 {
+		n = copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return
+	}
+	return c.Conn.Read(p)
+}
+
+// serveTLS wraps conn, which then handshakes on first use
+func serveTLS(conn net.Conn, conf *tls.Config) *tls.Conn {
+	return tls.Server(&rewindConn{Conn: conn}, conf)
+}
+
+// readProxyHeader reads any PROXY header sent by c's peer, which
+// precedes the TLS handshake on a TLS connection
+func (c *Conn) readProxyHeader(conf *ProxyConfig) (net.Addr, error) {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return readProxyHeader(c.buf, c.Conn.RemoteAddr(), conf)
+	}
+
+	rc := tc.NetConn().(*rewindConn)
+	b := core.NewRingBuf(DefaultBufSize, rc.Conn)
+
+	addr, err := readProxyHeader(b, rc.RemoteAddr(), conf)
+	if err == nil {
+		rc.pending = make([]byte, b.Available())
+		b.Read(rc.pending)
+	}
+
+	return addr, err
+}
+
+// TLSState returns the state of c's TLS connection, or nil if c is
+// not served over TLS
+func (c *Conn) TLSState() *tls.ConnectionState {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tc.ConnectionState()
+	return &state
+}
+
+// VerifiedChain returns the client's certificate chain, leaf first,
+// as verified against the server's tls.Config ClientCAs, or nil if
+// the client presented no verified certificate
+func (c *Conn) VerifiedChain() []*x509.Certificate {
+	state := c.TLSState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0]
+}
+
+// Subject returns the subject of the client's verified certificate,
+// or the zero Name if there is none
+func (c *Conn) Subject() pkix.Name {
+	if chain := c.VerifiedChain(); len(chain) > 0 {
+		return chain[0].Subject
+	}
+	return pkix.Name{}
+}
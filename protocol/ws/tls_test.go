@@ -0,0 +1,236 @@
+package ws_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert, key, pool}
+}
+
+// issue returns a certificate for cn, valid for loopback servers
+// and clients
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"wsgo"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mtlsServer runs a TLS server requiring client certificates from
+// ca, which only admits the client "svc-a" and replies to each data
+// frame with the client's common name and address
+func mtlsServer(t *testing.T, ca *testCA, set func(s *ws.Server)) string {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.TLS = &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "server")},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.pool,
+		}
+
+		s.Conf.OnHandshake = func(c *ws.Conn, target string, header func(string) string) error {
+			if c.Subject().CommonName != "svc-a" {
+				return errors.New("unknown service")
+			}
+			return nil
+		}
+
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			chain := c.VerifiedChain()
+			reply := c.Subject().CommonName + " " + chain[len(chain)-1].Subject.CommonName +
+				" " + c.RemoteAddr().String()
+
+			r := ws.NewMessage(ws.OpcodeText).SetPayload([]byte(reply))
+			r.FIN = true
+			r.Encode(c)
+		})
+
+		set(s)
+	})
+
+	return "wss" + strings.TrimPrefix(url, "ws")
+}
+
+func clientTLS(ca *testCA, certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs: ca.pool, Certificates: certs}
+}
+
+func whoami(c *ws.ClientConn) (string, error) {
+	m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("?"))
+	m.FIN = true
+	if err := m.Encode(c); err != nil {
+		return "", err
+	}
+	if err := m.Decode(c); err != nil {
+		return "", err
+	}
+	return string(m.Payload), nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCA(t)
+	url := mtlsServer(t, ca, func(*ws.Server) {})
+
+	c, err := ws.Dial(url, ws.ClientConfig{TLS: clientTLS(ca, ca.issue(t, "svc-a"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got, err := whoami(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "svc-a test CA 127.0.0.1:") {
+		t.Errorf("exp verified identity svc-a, got %q\n", got)
+	}
+
+	// verified, but refused by the handshake hook
+	_, err = ws.Dial(url, ws.ClientConfig{TLS: clientTLS(ca, ca.issue(t, "svc-b"))})
+
+	var herr *ws.HandshakeError
+	if !errors.As(err, &herr) || herr.StatusCode != "403" {
+		t.Errorf("exp 403 Forbidden for svc-b, got %v\n", err)
+	}
+
+	// no certificate, or one from another CA, fails the TLS handshake
+	other := newCA(t)
+	for _, conf := range []*tls.Config{clientTLS(ca), clientTLS(ca, other.issue(t, "svc-a"))} {
+		if c, err := ws.Dial(url, ws.ClientConfig{TLS: conf}); err == nil {
+			c.Close()
+			t.Errorf("exp unverified client refused\n")
+		} else if errors.As(err, &herr) {
+			t.Errorf("exp TLS failure, got %v\n", err)
+		}
+	}
+}
+
+func TestMutualTLSProxy(t *testing.T) {
+	ca := newCA(t)
+	url := mtlsServer(t, ca, func(s *ws.Server) {
+		s.Conf.Proxy = ws.ProxyConfig{
+			Protocol: true,
+			Trusted:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		}
+	})
+
+	// the PROXY header precedes the TLS handshake
+	c, err := ws.Dial(url, ws.ClientConfig{
+		TLS: clientTLS(ca, ca.issue(t, "svc-a")),
+		NetDial: func(network, address string) (net.Conn, error) {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 443\r\n"))
+			}
+			return conn, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got, err := whoami(c)
+	if err != nil || got != "svc-a test CA 203.0.113.7:5555" {
+		t.Errorf("exp svc-a via PROXY, got %q (%v)\n", got, err)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ca := newCA(t)
+	_, url := runServer(t, func(s *ws.Server) {
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server")}}
+		s.Conf.HandshakeTimeout = 50 * time.Millisecond
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			m.Encode(c)
+		})
+	})
+
+	// a peer which never starts its TLS handshake
+	stalled, err := net.Dial("tcp", strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	stalled.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("exp stalled handshake closed by the server, got %v\n", err)
+	}
+
+	// and does not hold up the next
+	c, err := ws.Dial("wss"+strings.TrimPrefix(url, "ws"), ws.ClientConfig{TLS: clientTLS(ca)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := echo(c, []byte("after")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/willmroliver/wsgo/protocol/http1"
+)
+
+// Upgrader performs the opening handshake on requests received by
+// a net/http server, so WebSocket endpoints can share its routing,
+// middleware and listeners. Conf.Path is validated as in Handshake.
+type Upgrader struct {
+	Conf ServerConfig
+}
+
+// Upgrade validates r as an opening handshake and hijacks the
+// underlying connection, writing the 101 response along with any
+// extra headers in hdr.
+//
+// Bytes the net/http server had already buffered past the request
+// are carried over into the returned Conn's read buffer. On failure
+// before the hijack, a 400 response is written to w.
+func (u *Upgrader) Upgrade(
+	w http.ResponseWriter,
+	r *http.Request,
+	hdr http.Header,
+) (c *Conn, err error) {
+	if err = u.Conf.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	if !u.Conf.Access.Allows(peer.Addr()) {
+		err = ErrAccessDenied
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	accept, err := checkUpgrade(
+		r.Method,
+		r.Proto,
+		r.URL.RequestURI(),
+		u.Conf.Path,
+		r.Header.Get,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var claims Claims
+	var protocol string
+	if u.Conf.Auth != nil {
+		claims, protocol, err = u.Conf.Auth.authenticate(r.URL.RequestURI(), r.Header.Get)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if protocol != "" && hdr.Get("Sec-WebSocket-Protocol") == "" {
+			hdr = hdr.Clone()
+			if hdr == nil {
+				hdr = make(http.Header)
+			}
+			hdr.Set("Sec-WebSocket-Protocol", protocol)
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		err = errors.New("response writer does not support hijacking")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	if c, err = NewConn(conn, u.Conf); err != nil {
+		conn.Close()
+		return
+	}
+
+	c.rate = newRateLimit(u.Conf.rateConfig(r.URL.Path))
+	c.claims = claims
+
+	if u.Conf.Proxy.Headers {
+		c.remote = forwardedAddr(&u.Conf.Proxy, conn.RemoteAddr(), r.Header.Values)
+	}
+
+	if u.Conf.OnHandshake != nil {
+		if err = u.Conf.OnHandshake(c, r.URL.RequestURI(), r.Header.Get); err != nil {
+			reject(c, "403 Forbidden", nil)
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if n := brw.Reader.Buffered(); n > 0 {
+		p, _ := brw.Reader.Peek(n)
+		if _, err = c.buf.Write(p); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols" + http1.CRLF)
+	b.WriteString("Upgrade: websocket" + http1.CRLF)
+	b.WriteString("Connection: Upgrade" + http1.CRLF)
+	b.WriteString("Sec-Websocket-Accept: " + accept + http1.CRLF)
+	hdr.Write(&b)
+	b.WriteString(http1.CRLF)
+
+	if _, err = c.Write([]byte(b.String())); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.open.Store(true)
+	return
+}
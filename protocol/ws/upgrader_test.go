@@ -0,0 +1,124 @@
+package ws_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func TestUpgrade(t *testing.T) {
+	frames := make(chan string, 1)
+
+	u := &ws.Upgrader{Conf: ws.ServerConfig{Path: "/chat"}}
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			c, err := u.Upgrade(w, r, http.Header{"X-Node": {"a1"}})
+			if err != nil {
+				return
+			}
+			defer c.Conn.Close()
+
+			m := new(ws.Message)
+			if err := m.Decode(c); err != nil {
+				frames <- err.Error()
+				return
+			}
+
+			frames <- string(m.UnsafeMask().Payload)
+		},
+	))
+	defer s.Close()
+
+	t.Run("Rejects bad requests", func(t *testing.T) {
+		res, err := http.Get(s.URL + "/chat")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res.Body.Close()
+
+		if exp := http.StatusBadRequest; res.StatusCode != exp {
+			t.Errorf("exp %d, got %d\n", exp, res.StatusCode)
+		}
+	})
+
+	t.Run("Keeps buffered frames", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		f := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("early"))
+		f.FIN = true
+		f.MaskingKey = [4]byte{1, 2, 3, 4}
+		f.ApplyMask()
+		frame, _ := f.EncodeBytes()
+
+		// the request and first frame arrive in a single segment,
+		// so net/http reads the frame into its bufio.Reader
+		req := "GET /chat HTTP/1.1\r\n" +
+			"Host: example.com\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: keep-alive, Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Sec-WebSocket-Version: 13\r\n" +
+			"\r\n"
+
+		conn.Write(append([]byte(req), frame...))
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if exp := http.StatusSwitchingProtocols; res.StatusCode != exp {
+			t.Errorf("exp %d, got %d\n", exp, res.StatusCode)
+		}
+		if exp, got := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"); exp != got {
+			t.Errorf("accept: exp %s, got %s\n", exp, got)
+		}
+		if exp, got := "a1", res.Header.Get("X-Node"); exp != got {
+			t.Errorf("X-Node: exp %s, got %s\n", exp, got)
+		}
+
+		if exp, got := "early", <-frames; exp != got {
+			t.Errorf("exp %q, got %q\n", exp, got)
+		}
+	})
+}
+
+func TestUpgradeRejectQueued(t *testing.T) {
+	u := &ws.Upgrader{Conf: ws.ServerConfig{
+		Queue: ws.QueueConfig{Size: 4},
+		OnHandshake: func(*ws.Conn, string, func(string) string) error {
+			return errors.New("forbidden")
+		},
+	}}
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u.Upgrade(w, r, nil)
+		},
+	))
+	defer s.Close()
+
+	// the 403 is flushed through the write queue before closing
+	for range 20 {
+		_, err := ws.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/", ws.ClientConfig{})
+
+		var herr *ws.HandshakeError
+		if !errors.As(err, &herr) || herr.StatusCode != "403" {
+			t.Fatalf("exp 403 Forbidden, got %v\n", err)
+		}
+	}
+}
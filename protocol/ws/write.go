@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"net"
+	"sync"
+
+	"github.com/willmroliver/wsgo/core"
+)
+
+// writeLock serialises writers on a connection.
+//
+// Each frame is written under the frame lock, so frame bytes never
+// interleave. Data frames also hold msg for their whole message,
+// so fragments of different messages never interleave, while
+// control frames take only the frame lock and are given priority:
+// they may be sent between the fragments of a message in progress.
+type writeLock struct {
+	msg sync.Mutex
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	busy    bool
+	control int
+}
+
+func (l *writeLock) lock(control bool) {
+	l.mu.Lock()
+	if l.cond.L == nil {
+		l.cond.L = &l.mu
+	}
+
+	if control {
+		l.control++
+	}
+
+	for l.busy || (!control && l.control > 0) {
+		l.cond.Wait()
+	}
+
+	if control {
+		l.control--
+	}
+
+	l.busy = true
+	l.mu.Unlock()
+}
+
+func (l *writeLock) unlock() {
+	l.mu.Lock()
+	l.busy = false
+	if l.cond.L != nil {
+		l.cond.Broadcast()
+	}
+	l.mu.Unlock()
+}
+
+// frameConn is implemented by the connections in this package,
+// which coordinate concurrent writers
+type frameConn interface {
+	writeLock() *writeLock
+	writeFrame(op byte, p []byte) error
+	writeBuffers(op byte, bufs net.Buffers) error
+}
+
+// lockFrame acquires c's locks for writing a frame with opcode op,
+// returning the lock to pass to unlockFrame (nil if c has none)
+func lockFrame(c core.Conn, op byte) *writeLock {
+	fc, ok := c.(frameConn)
+	if !ok {
+		return nil
+	}
+
+	l := fc.writeLock()
+	if !isControl(op) {
+		l.msg.Lock()
+	}
+
+	l.lock(isControl(op))
+	return l
+}
+
+func unlockFrame(l *writeLock, op byte) {
+	if l == nil {
+		return
+	}
+
+	l.unlock()
+	if !isControl(op) {
+		l.msg.Unlock()
+	}
+}
+
+// writeFrame writes p to c as a single frame, or part of one
+func writeFrame(c core.Conn, op byte, p []byte) (err error) {
+	if fc, ok := c.(frameConn); ok {
+		return fc.writeFrame(op, p)
+	}
+
+	_, err = c.Write(p)
+	return
+}
+
+// writeBuffers writes bufs to c as a single frame
+func writeBuffers(c core.Conn, op byte, bufs net.Buffers) (err error) {
+	if fc, ok := c.(frameConn); ok {
+		return fc.writeBuffers(op, bufs)
+	}
+
+	_, err = bufs.WriteTo(c)
+	return
+}
+
+func isControl(op byte) bool {
+	return op&0x8 != 0
+}
@@ -0,0 +1,221 @@
+package ws_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willmroliver/wsgo/protocol/ws"
+)
+
+func TestConcurrentWrites(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	w, r := ws.WrapConn(a), ws.WrapConn(b)
+
+	const writers, msgs = 8, 50
+	var wg sync.WaitGroup
+
+	for id := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			payload := bytes.Repeat([]byte{byte(id)}, 0x800*(id%3+1))
+
+			for range msgs {
+				m := ws.NewMessage(ws.OpcodeBinary).SetPayload(payload)
+				m.FIN = true
+
+				var err error
+				if id%2 == 0 {
+					err = m.EncodeFragments(w, 0x300)
+				} else {
+					err = m.Encode(w)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for range msgs {
+			if err := ws.PingFrame.Encode(w); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		a.Close()
+	}()
+
+	var (
+		counts  [writers]int
+		pings   int
+		message []byte
+	)
+
+	m := new(ws.Message)
+
+	for m.Decode(r) == nil {
+		switch m.Opcode {
+		case ws.OpcodePing:
+			pings++
+			continue
+		case ws.OpcodeCont:
+			if message == nil {
+				t.Fatalf("unexpected continuation frame\n")
+			}
+		default:
+			if message != nil {
+				t.Fatalf("data frame interleaved with a fragmented message\n")
+			}
+			message = []byte{}
+		}
+
+		message = append(message, m.Payload...)
+		if !m.FIN {
+			continue
+		}
+
+		id := message[0]
+		if !bytes.Equal(message, bytes.Repeat([]byte{id}, 0x800*(int(id)%3+1))) {
+			t.Fatalf("message from writer %d corrupted\n", id)
+		}
+
+		counts[id]++
+		message = nil
+	}
+
+	for id, n := range counts {
+		if n != msgs {
+			t.Errorf("exp %d messages from writer %d, got %d\n", msgs, id, n)
+		}
+	}
+	if pings != msgs {
+		t.Errorf("exp %d pings, got %d\n", msgs, pings)
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	_, url := runServer(t, func(s *ws.Server) {
+		s.Handler = ws.HandlerFunc(func(c *ws.Conn, m *ws.Message) {
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.Close()
+				}()
+			}
+			wg.Wait()
+		})
+	})
+
+	c, err := ws.Dial(url, ws.ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	m := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("close"))
+	m.FIN = true
+	if err := m.Encode(c); err != nil {
+		t.Fatal(err)
+	}
+
+	closes := 0
+	for m.Decode(c) == nil {
+		if m.Opcode == ws.OpcodeClose {
+			closes++
+		}
+	}
+
+	if closes != 1 {
+		t.Errorf("exp 1 close frame, got %d\n", closes)
+	}
+}
+
+func TestControlBetweenFragments(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	w, r := ws.WrapConn(a), ws.WrapConn(b)
+
+	big := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("abcdef"))
+	big.FIN = true
+
+	small := ws.NewMessage(ws.OpcodeText).SetPayload([]byte("x"))
+	small.FIN = true
+
+	go big.EncodeFragments(w, 2)
+
+	m := new(ws.Message)
+	if err := m.Decode(r); err != nil || string(m.Payload) != "ab" {
+		t.Fatalf("exp first fragment, got %q (%v)\n", m.Payload, err)
+	}
+
+	// let the second fragment block on the pipe, then queue a data
+	// frame and a ping behind it: the ping is sent before the third
+	// fragment, the data frame after the last
+	time.Sleep(20 * time.Millisecond)
+
+	go small.Encode(w)
+	go ws.PingFrame.Encode(w)
+	time.Sleep(20 * time.Millisecond)
+
+	exp := []struct {
+		op      byte
+		payload string
+	}{
+		{ws.OpcodeCont, "cd"},
+		{ws.OpcodePing, ""},
+		{ws.OpcodeCont, "ef"},
+		{ws.OpcodeText, "x"},
+	}
+
+	for _, e := range exp {
+		if err := m.Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		if m.Opcode != e.op || string(m.Payload) != e.payload {
+			t.Errorf("exp opcode %d %q, got %d %q\n", e.op, e.payload, m.Opcode, m.Payload)
+		}
+	}
+}
+
+func TestQueuePingJumpsAhead(t *testing.T) {
+	c, g := queuedConn(ws.QueueBlock)
+
+	frame(1).Encode(c)
+	<-g.entered
+
+	frame(2).Encode(c)
+	frame(3).Encode(c)
+	ws.PingFrame.Encode(c)
+
+	close(g.release)
+	c.Close()
+
+	writes, _ := g.Writes()
+	got := bytes.Join(writes, nil)
+
+	exp := [][]byte{{0x82, 1, 1}, {0x89, 0}, {0x82, 1, 2}, {0x82, 1, 3}}
+	if !bytes.Equal(got, bytes.Join(exp, nil)) {
+		t.Errorf("exp ping ahead of queued data, got % x\n", got)
+	}
+}